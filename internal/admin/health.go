@@ -0,0 +1,60 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// checkTimeout bounds a whole health or readiness request, so a hanging
+// dependency fails the probe instead of stalling it
+const checkTimeout = 3 * time.Second
+
+// CheckFunc reports the state of one dependency. The detail, if any, is shown
+// to operators whether or not the check passed.
+type CheckFunc func(ctx context.Context) (detail any, err error)
+
+// Check is a named dependency of a health endpoint
+type Check struct {
+	Name string
+	Run  CheckFunc
+}
+
+type checkResult struct {
+	OK     bool   `json:"ok"`
+	Detail any    `json:"detail,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type healthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks"`
+}
+
+// healthHandler runs every check and answers 200 if all of them pass and 503
+// otherwise, with the result of each check in the body
+func healthHandler(checks []Check) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+		defer cancel()
+
+		response := healthResponse{Status: "ok", Checks: make(map[string]checkResult, len(checks))}
+		for _, check := range checks {
+			detail, err := check.Run(ctx)
+			result := checkResult{OK: err == nil, Detail: detail}
+			if err != nil {
+				result.Error = err.Error()
+				response.Status = "failing"
+			}
+			response.Checks[check.Name] = result
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if response.Status != "ok" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(response)
+	})
+}
@@ -0,0 +1,58 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"gprxy/internal/logger"
+	"gprxy/internal/metrics"
+)
+
+// shutdownTimeout bounds how long in-flight admin requests may delay shutdown
+const shutdownTimeout = 5 * time.Second
+
+// Server is the HTTP admin listener serving /metrics, /healthz and /readyz. It
+// never carries client traffic.
+type Server struct {
+	addr string
+	mux  *http.ServeMux
+}
+
+// NewServer creates an admin server listening on addr. /healthz passes while
+// every liveness check does and /readyz while every readiness check does.
+func NewServer(addr string, liveness, readiness []Check) *Server {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", metrics.Handler())
+	mux.Handle("GET /healthz", healthHandler(liveness))
+	mux.Handle("GET /readyz", healthHandler(readiness))
+	return &Server{addr: addr, mux: mux}
+}
+
+// Start serves admin requests until ctx is cancelled
+func (s *Server) Start(ctx context.Context) error {
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return logger.Errorf("failed to start admin listener: %w", err)
+	}
+
+	server := &http.Server{
+		Handler:           s.mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	logger.Info("admin listener on %s (/metrics, /healthz, /readyz)", ln.Addr())
+	err = server.Serve(ln)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return logger.Errorf("admin listener failed: %w", err)
+	}
+	return nil
+}
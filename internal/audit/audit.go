@@ -0,0 +1,159 @@
+// Package audit writes a JSON line for every statement a client runs,
+// attributed to the person behind the connection rather than only to the
+// service account the statement ran as
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joho/godotenv"
+	"gopkg.in/natefinch/lumberjack.v2"
+
+	"gprxy/internal/logger"
+)
+
+const (
+	defaultMaxSizeMB  = 100
+	defaultMaxBackups = 10
+)
+
+// Redaction says which literal values are masked in audited SQL
+type Redaction string
+
+const (
+	// RedactNone records statements as the client sent them
+	RedactNone Redaction = "none"
+	// RedactStrings masks string literals and dollar-quoted bodies
+	RedactStrings Redaction = "strings"
+	// RedactLiterals also masks numeric literals
+	RedactLiterals Redaction = "literals"
+)
+
+// Record is one audited statement. Simple queries are recorded per Query
+// message and extended-protocol statements per Execute.
+type Record struct {
+	Time           time.Time `json:"time"`
+	ConnID         string    `json:"conn_id"`
+	Email          string    `json:"email,omitempty"`
+	Subject        string    `json:"subject,omitempty"`
+	AuthMethod     string    `json:"auth_method"`
+	ServiceAccount string    `json:"service_account"`
+	Database       string    `json:"database"`
+	Client         string    `json:"client"`
+	Listener       string    `json:"listener"`
+	Route          string    `json:"route,omitempty"`
+	Protocol       string    `json:"protocol"`            // simple or extended
+	Statement      string    `json:"statement,omitempty"` // Prepared statement name, for extended protocol
+	SQL            string    `json:"sql"`
+	Params         int       `json:"params"` // Parameters bound by the client, never their values
+	CommandTag     string    `json:"command_tag,omitempty"`
+	Rows           *int64    `json:"rows,omitempty"`
+	DurationMS     float64   `json:"duration_ms"`
+	ErrorCode      string    `json:"error_code,omitempty"`
+	Incomplete     bool      `json:"incomplete,omitempty"` // The client left before the reply finished
+}
+
+// Log is an audit sink. A nil *Log discards every record.
+type Log struct {
+	mu        sync.Mutex
+	out       io.Writer
+	closer    io.Closer
+	redaction Redaction
+}
+
+// Load opens the audit log configured by AUDIT_LOG. Returns nil if auditing
+// is not configured.
+func Load() *Log {
+	err := godotenv.Load(".env")
+	if err != nil {
+		logger.Debug("no .env file found, using system environment")
+	}
+
+	target := os.Getenv("AUDIT_LOG")
+	if target == "" {
+		return nil
+	}
+
+	redaction := Redaction(strings.ToLower(os.Getenv("AUDIT_REDACT")))
+	switch redaction {
+	case "":
+		redaction = RedactLiterals
+	case RedactNone, RedactStrings, RedactLiterals:
+	default:
+		log.Fatalf("invalid AUDIT_REDACT %q (expected none, strings or literals)", redaction)
+	}
+
+	if target == "stdout" {
+		logger.Info("audit log: stdout (redaction: %s)", redaction)
+		return &Log{out: os.Stdout, redaction: redaction}
+	}
+
+	maxSize := envInt("AUDIT_LOG_MAX_SIZE_MB", defaultMaxSizeMB)
+	maxBackups := envInt("AUDIT_LOG_MAX_BACKUPS", defaultMaxBackups)
+	file := &lumberjack.Logger{
+		Filename:   target,
+		MaxSize:    maxSize,
+		MaxBackups: maxBackups,
+	}
+	logger.Info("audit log: %s (rotated at %d MB, %d backups kept, redaction: %s)", target, maxSize, maxBackups, redaction)
+	return &Log{out: file, closer: file, redaction: redaction}
+}
+
+func envInt(name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		log.Fatalf("invalid %s %q (expected a non-negative integer)", name, value)
+	}
+	return n
+}
+
+// Enabled reports whether records are written anywhere
+func (l *Log) Enabled() bool {
+	return l != nil
+}
+
+// Redaction returns the literal masking applied to audited SQL
+func (l *Log) Redaction() Redaction {
+	if l == nil {
+		return RedactLiterals
+	}
+	return l.redaction
+}
+
+// Write appends a record as one JSON line
+func (l *Log) Write(record *Record) {
+	if l == nil {
+		return
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		logger.Error("failed to encode audit record: %v", err)
+		return
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.out.Write(line); err != nil {
+		logger.Error("failed to write audit record: %v", err)
+	}
+}
+
+// Close flushes and closes the audit file
+func (l *Log) Close() error {
+	if l == nil || l.closer == nil {
+		return nil
+	}
+	return l.closer.Close()
+}
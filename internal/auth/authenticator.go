@@ -1,7 +1,9 @@
 package auth
 
 import (
+	"context"
 	"crypto/md5"
+	"crypto/x509"
 	"fmt"
 	"io"
 	"net"
@@ -10,8 +12,14 @@ import (
 
 	"github.com/jackc/pgproto3/v2"
 	"github.com/xdg-go/scram"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
+	"gprxy/internal/config"
 	"gprxy/internal/logger"
+	"gprxy/internal/metrics"
+	"gprxy/internal/tls"
+	"gprxy/internal/tracing"
 )
 
 var (
@@ -33,157 +41,252 @@ func InitializeAuth(issuer, audience, jwksurl string) error {
 	return nil
 }
 
+// Identity is who a client authenticated as
+type Identity struct {
+	Method         string // cert, jwt or password
+	Email          string // From the access token
+	Subject        string // Token subject, or the client certificate's subject
+	ServiceAccount string // PostgreSQL role the client's statements run as
+}
+
 // AuthenticateUser authenticates a user with PostgreSQL using a temporary connection
 // The proxy acts as a PostgreSQL client and handles all authentication methods (SCRAM, MD5, etc.)
-func AuthenticateUser(user, database, host string, startUpMessage *pgproto3.StartupMessage, clientBackend *pgproto3.Backend, clientAddr string) (pgproto3.BackendKeyData, error) {
-	backendAddress := net.JoinHostPort(host, "5432")
-	logger.Debug("connecting to PostgreSQL at %s as %s for authentication", backendAddress, user)
+// Clients may only use the methods their listener allows, and everything is
+// logged through the connection's logger and traced under ctx. On success it
+// returns the backend key of the authentication connection and the client's
+// identity.
+func AuthenticateUser(ctx context.Context, log *logger.Logger, user, database string, upstream *config.Upstream, methods config.AuthMethods, clientCert *x509.Certificate, startUpMessage *pgproto3.StartupMessage, clientBackend *pgproto3.Backend, clientAddr string) (_ pgproto3.BackendKeyData, _ *Identity, err error) {
+	start := time.Now()
+	method := "unknown"
+	ctx, span := tracing.Tracer().Start(ctx, "auth.authenticate", trace.WithAttributes(
+		attribute.String("gprxy.upstream", upstream.Name),
+		attribute.String("db.name", database),
+	))
+	defer func() {
+		metrics.AuthDuration.WithLabelValues(method, metrics.Result(err)).Observe(metrics.Since(start))
+		span.SetAttributes(attribute.String("gprxy.auth.method", method))
+		tracing.End(span, err)
+	}()
+
+	log.Debug("connecting to PostgreSQL at %s as %s for authentication", upstream.Address(), user)
+
+	rawConnection, err := net.DialTimeout("tcp", upstream.Address(), 10*time.Second)
+	if err != nil {
+		log.Error("failed to connect to PostgreSQL: %v", err)
+		return pgproto3.BackendKeyData{}, nil, sendErrorToClient(log, clientBackend, "Backend Unavailable")
+	}
+	defer rawConnection.Close()
 
-	tempConnection, err := net.DialTimeout("tcp", backendAddress, 10*time.Second)
+	tempConnection, err := tls.ConnectUpstream(rawConnection, upstream)
 	if err != nil {
-		logger.Error("failed to connect to PostgreSQL: %v", err)
-		return pgproto3.BackendKeyData{}, sendErrorToClient(clientBackend, "Backend Unavailable")
+		log.Error("failed to secure connection to PostgreSQL: %v", err)
+		return pgproto3.BackendKeyData{}, nil, sendErrorToClient(log, clientBackend, "Backend Unavailable")
 	}
 	defer tempConnection.Close()
 
-	// First, ask the client for their password
-	password, err := requestPasswordFromClient(clientBackend, clientAddr)
-	if err != nil {
-		logger.Error("failed to get password from client: %v", err)
-		return pgproto3.BackendKeyData{}, sendErrorToClient(clientBackend, "Authentication failed")
+	var account *ServiceAccount
+	if methods.Certificate {
+		account = certificateAccount(log, clientCert)
 	}
-	var actualUsername, actualPassword string
-	// Checking if it's a JWT token
-	if strings.HasPrefix(password, "eyJ") && strings.Count(password, ".") == 2 {
-		logger.Debug("jwt token received")
 
-		oauth, err := jwtValidator.ValidateJWT(password)
+	identity := &Identity{}
+	var actualUsername, actualPassword string
+	if account != nil {
+		// A mapped client certificate replaces the password exchange
+		method = "cert"
+		identity.Subject = clientCert.Subject.String()
+		actualUsername = account.Username
+		actualPassword = account.Password
+	} else if !methods.JWT && !methods.Password {
+		log.Warn("rejecting %s: no mapped client certificate on a certificate-only listener", clientAddr)
+		return pgproto3.BackendKeyData{}, nil, sendErrorToClient(log, clientBackend, "Client certificate required")
+	} else {
+		// First, ask the client for their password
+		password, err := requestPasswordFromClient(log, clientBackend, clientAddr)
 		if err != nil {
-			logger.Errorf("jwt validation failed: %v", err)
-			return pgproto3.BackendKeyData{}, sendErrorToClient(clientBackend, "Invalid authentication token")
+			log.Error("failed to get password from client: %v", err)
+			return pgproto3.BackendKeyData{}, nil, sendErrorToClient(log, clientBackend, "Authentication failed")
 		}
-		svcAcc, err := roleMapper.MapRoleToServiceAccount(oauth.Roles)
-		if err != nil {
-			logger.Errorf("role mapping failed for user %s: %v", oauth.Email, err)
-			return pgproto3.BackendKeyData{}, sendErrorToClient(clientBackend, "Access denied: no valid roles")
+		// Checking if it's a JWT token
+		isJWT := strings.HasPrefix(password, "eyJ") && strings.Count(password, ".") == 2
+		method = "password"
+		if isJWT {
+			method = "jwt"
+		}
+		if isJWT && !methods.JWT {
+			log.Warn("rejecting %s: JWT authentication is not allowed on this listener", clientAddr)
+			return pgproto3.BackendKeyData{}, nil, sendErrorToClient(log, clientBackend, "Token authentication is not allowed on this port")
+		}
+		if !isJWT && !methods.Password {
+			log.Warn("rejecting %s: password authentication is not allowed on this listener", clientAddr)
+			return pgproto3.BackendKeyData{}, nil, sendErrorToClient(log, clientBackend, "Password authentication is not allowed on this port, use an access token")
 		}
 
-		oauth.ServiceAccount = svcAcc.Username
-		actualUsername = svcAcc.Username
-		actualPassword = svcAcc.Password
+		if isJWT {
+			log.Debug("jwt token received")
 
-		logger.Info("user %s (roles: %v) mapped to service account: %s",
-			oauth.Email, oauth.Roles, svcAcc.Username)
-	} else {
-		// Traditional password authentication (fallback)
-		logger.Debug("Traditional password authentication for user: %s", user)
-		actualUsername = user
-		actualPassword = password
+			oauth, err := jwtValidator.ValidateJWT(ctx, log, password)
+			if err != nil {
+				log.Errorf("jwt validation failed: %v", err)
+				return pgproto3.BackendKeyData{}, nil, sendErrorToClient(log, clientBackend, "Invalid authentication token")
+			}
+			span.SetAttributes(attribute.String("enduser.id", oauth.Subject))
+			svcAcc, err := roleMapper.MapRoleToServiceAccount(log, oauth.Roles)
+			if err != nil {
+				log.Errorf("role mapping failed for user %s: %v", oauth.Email, err)
+				return pgproto3.BackendKeyData{}, nil, sendErrorToClient(log, clientBackend, "Access denied: no valid roles")
+			}
+
+			oauth.ServiceAccount = svcAcc.Username
+			identity.Email = oauth.Email
+			identity.Subject = oauth.Subject
+			actualUsername = svcAcc.Username
+			actualPassword = svcAcc.Password
+
+			log.Info("user %s (roles: %v) mapped to service account: %s",
+				oauth.Email, oauth.Roles, svcAcc.Username)
+		} else {
+			// Traditional password authentication (fallback)
+			log.Debug("Traditional password authentication for user: %s", user)
+			actualUsername = user
+			actualPassword = password
+		}
 	}
 	startUpMessage.Parameters["user"] = actualUsername
+	startUpMessage.Parameters["database"] = database
 	tempFrontend := pgproto3.NewFrontend(pgproto3.NewChunkReader(tempConnection), tempConnection)
-	logger.Debug("sending startup message to PostgreSQL")
+	log.Debug("sending startup message to PostgreSQL")
 	err = tempFrontend.Send(startUpMessage)
 	if err != nil {
-		logger.Error("failed to send startup message: %v", err)
-		return pgproto3.BackendKeyData{}, sendErrorToClient(clientBackend, "Authentication failed")
+		log.Error("failed to send startup message: %v", err)
+		return pgproto3.BackendKeyData{}, nil, sendErrorToClient(log, clientBackend, "Authentication failed")
 	}
 
 	// Now authenticate WITH PostgreSQL using the service account credentials
 	var backendKeyData *pgproto3.BackendKeyData
-	err = authenticateWithBackend(tempFrontend, clientBackend, actualUsername, actualPassword, clientAddr, &backendKeyData)
+	err = authenticateWithBackend(ctx, log, tempFrontend, clientBackend, actualUsername, actualPassword, clientAddr, &backendKeyData)
 	if err != nil {
-		logger.Error("authentication with backend failed: %v", err)
-		return pgproto3.BackendKeyData{}, err
+		log.Error("authentication with backend failed: %v", err)
+		return pgproto3.BackendKeyData{}, nil, err
 	}
 
-	logger.Debug("authentication completed successfully")
-	return *backendKeyData, nil
+	log.Debug("authentication completed successfully")
+	identity.Method = method
+	identity.ServiceAccount = actualUsername
+	return *backendKeyData, identity, nil
+}
+
+// certificateAccount returns the service account mapped to a verified client
+// certificate, or nil if there is no certificate or it is not mapped
+func certificateAccount(log *logger.Logger, clientCert *x509.Certificate) *ServiceAccount {
+	if clientCert == nil {
+		return nil
+	}
+	account, err := roleMapper.MapCertificateToServiceAccount(log, clientCert)
+	if err != nil {
+		log.Debug("client certificate not used for authentication: %v", err)
+		return nil
+	}
+	log.Info("client certificate %s mapped to service account: %s", clientCert.Subject, account.Username)
+	return account
 }
 
 // requestPasswordFromClient asks the client for their password
 // We send an AuthenticationCleartextPassword request to the client
-func requestPasswordFromClient(clientBackend *pgproto3.Backend, clientAddr string) (string, error) {
+func requestPasswordFromClient(log *logger.Logger, clientBackend *pgproto3.Backend, clientAddr string) (string, error) {
 	// Ask client for cleartext password
 	err := clientBackend.Send(&pgproto3.AuthenticationCleartextPassword{})
 	if err != nil {
-		return "", logger.Errorf("failed to request password: %w", err)
+		return "", log.Errorf("failed to request password: %w", err)
 	}
 
 	// Receive password from client
 	msg, err := clientBackend.Receive()
 	if err != nil {
-		return "", logger.Errorf("failed to receive password: %w", err)
+		return "", log.Errorf("failed to receive password: %w", err)
 	}
 
 	passwordMsg, ok := msg.(*pgproto3.PasswordMessage)
 	if !ok {
-		return "", logger.Errorf("expected PasswordMessage, got %T", msg)
+		return "", log.Errorf("expected PasswordMessage, got %T", msg)
 	}
 	return passwordMsg.Password, nil
 }
 
 // authenticateWithBackend performs authentication WITH the PostgreSQL backend
 // The proxy acts as a PostgreSQL client and handles SCRAM, MD5, etc.
-func authenticateWithBackend(frontend *pgproto3.Frontend, clientBackend *pgproto3.Backend, username, password, clientAddr string, backendKeyData **pgproto3.BackendKeyData) error {
+// The exchange is traced as a span, with a child span for the SCRAM
+// conversation and an event for each of its steps.
+func authenticateWithBackend(ctx context.Context, log *logger.Logger, frontend *pgproto3.Frontend, clientBackend *pgproto3.Backend, username, password, clientAddr string, backendKeyData **pgproto3.BackendKeyData) (err error) {
 	var scramConversation *scram.ClientConversation
 
+	ctx, span := tracing.Tracer().Start(ctx, "auth.backend", trace.WithAttributes(attribute.String("db.user", username)))
+	var scramSpan trace.Span
+	defer func() {
+		if scramSpan != nil {
+			tracing.End(scramSpan, err)
+		}
+		tracing.End(span, err)
+	}()
+
 	for {
 		msg, err := frontend.Receive()
 		if err != nil {
-			return logger.Errorf("failed to receive from backend: %w", err)
+			return log.Errorf("failed to receive from backend: %w", err)
 		}
 
-		logger.Debug("backend auth message: %T", msg)
+		log.Debug("backend auth message: %T", msg)
 
 		switch authMsg := msg.(type) {
 		case *pgproto3.ErrorResponse:
-			logger.Error("backend auth error: %s - %s", authMsg.Code, authMsg.Message)
+			log.Error("backend auth error: %s - %s", authMsg.Code, authMsg.Message)
 			// Forward error to client
 			clientBackend.Send(authMsg)
-			return logger.Errorf("backend auth error: %s", authMsg.Message)
+			return log.Errorf("backend auth error: %s", authMsg.Message)
 
 		case *pgproto3.AuthenticationOk:
-			logger.Debug("backend authentication OK")
+			log.Debug("backend authentication OK")
 			// Send AuthenticationOk to client
 			err := clientBackend.Send(&pgproto3.AuthenticationOk{})
 			if err != nil {
-				return logger.Errorf("failed to send AuthenticationOk to client: %w", err)
+				return log.Errorf("failed to send AuthenticationOk to client: %w", err)
 			}
 			continue
 
 		case *pgproto3.ReadyForQuery:
-			logger.Debug("temp auth connection ready for queries (will not forward ReadyForQuery yet)")
+			log.Debug("temp auth connection ready for queries (will not forward ReadyForQuery yet)")
 			// DO NOT send ReadyForQuery to client yet
 			// The client will receive ReadyForQuery after the pool connection's BackendKeyData is sent
 			return nil
 
 		case *pgproto3.ParameterStatus:
-			logger.Debug("parameter status: %s = %s", authMsg.Name, authMsg.Value)
+			log.Debug("parameter status: %s = %s", authMsg.Name, authMsg.Value)
 
 			// Forward to client
 			err := clientBackend.Send(authMsg)
 			if err != nil {
-				return logger.Errorf("failed to forward ParameterStatus: %w", err)
+				return log.Errorf("failed to forward ParameterStatus: %w", err)
 			}
 			continue
 
 		case *pgproto3.BackendKeyData:
-			logger.Debug("temp auth connection backend key data received (will not forward): PID=%d, secret_key=%d", authMsg.ProcessID, authMsg.SecretKey)
+			log.Debug("temp auth connection backend key data received (will not forward): PID=%d, secret_key=%d", authMsg.ProcessID, authMsg.SecretKey)
 			// Store the BackendKeyData but DO NOT forward to client
 			// The client will receive the pool connection's BackendKeyData later
 			*backendKeyData = authMsg
 			continue
 
 		case *pgproto3.AuthenticationCleartextPassword:
-			logger.Debug("backend requests cleartext password")
+			log.Debug("backend requests cleartext password")
+			span.SetAttributes(attribute.String("gprxy.auth.mechanism", "password"))
 			err := frontend.Send(&pgproto3.PasswordMessage{Password: password})
 			if err != nil {
-				return logger.Errorf("failed to send cleartext password: %w", err)
+				return log.Errorf("failed to send cleartext password: %w", err)
 			}
 
 		case *pgproto3.AuthenticationMD5Password:
-			logger.Debug("backend requests MD5 password")
+			log.Debug("backend requests MD5 password")
+			span.SetAttributes(attribute.String("gprxy.auth.mechanism", "md5"))
 			// Compute MD5 hash: md5(md5(password + username) + salt)
 			h1 := md5.New()
 			io.WriteString(h1, password)
@@ -195,11 +298,11 @@ func authenticateWithBackend(frontend *pgproto3.Frontend, clientBackend *pgproto
 
 			err := frontend.Send(&pgproto3.PasswordMessage{Password: passwordHash})
 			if err != nil {
-				return logger.Errorf("failed to send MD5 password: %w", err)
+				return log.Errorf("failed to send MD5 password: %w", err)
 			}
 
 		case *pgproto3.AuthenticationSASL:
-			logger.Debug("backend requests SASL auth, mechanisms: %v", authMsg.AuthMechanisms)
+			log.Debug("backend requests SASL auth, mechanisms: %v", authMsg.AuthMechanisms)
 
 			// Check if SCRAM-SHA-256 is supported
 			scramSupported := false
@@ -211,62 +314,71 @@ func authenticateWithBackend(frontend *pgproto3.Frontend, clientBackend *pgproto
 			}
 
 			if !scramSupported {
-				return logger.Errorf("SCRAM-SHA-256 not supported by backend, available: %v", authMsg.AuthMechanisms)
+				return log.Errorf("SCRAM-SHA-256 not supported by backend, available: %v", authMsg.AuthMechanisms)
 			}
 
+			span.SetAttributes(attribute.String("gprxy.auth.mechanism", "SCRAM-SHA-256"))
+			_, scramSpan = tracing.Tracer().Start(ctx, "auth.scram")
+
 			// Create SCRAM client - the proxy acts as the SCRAM client to PostgreSQL
 			client, err := scram.SHA256.NewClient(username, password, "")
 			if err != nil {
-				return logger.Errorf("failed to create SCRAM client: %w", err)
+				return log.Errorf("failed to create SCRAM client: %w", err)
 			}
 
 			scramConversation = client.NewConversation()
 			initialResponse, err := scramConversation.Step("")
 			if err != nil {
-				return logger.Errorf("SCRAM initial step failed: %w", err)
+				return log.Errorf("SCRAM initial step failed: %w", err)
 			}
 
-			logger.Debug("sending SCRAM initial response to backend")
+			log.Debug("sending SCRAM initial response to backend")
+			scramSpan.AddEvent("client-first-message")
 			err = frontend.Send(&pgproto3.SASLInitialResponse{
 				AuthMechanism: "SCRAM-SHA-256",
 				Data:          []byte(initialResponse),
 			})
 			if err != nil {
-				return logger.Errorf("failed to send SASL initial response: %w", err)
+				return log.Errorf("failed to send SASL initial response: %w", err)
 			}
 
 		case *pgproto3.AuthenticationSASLContinue:
-			logger.Debug("backend SASL continue")
+			log.Debug("backend SASL continue")
 			if scramConversation == nil {
-				return logger.Errorf("received SASL continue without conversation")
+				return log.Errorf("received SASL continue without conversation")
 			}
 
+			scramSpan.AddEvent("server-first-message")
 			response, err := scramConversation.Step(string(authMsg.Data))
 			if err != nil {
-				return logger.Errorf("SCRAM continue step failed: %w", err)
+				return log.Errorf("SCRAM continue step failed: %w", err)
 			}
+			scramSpan.AddEvent("client-final-message")
 
 			err = frontend.Send(&pgproto3.SASLResponse{
 				Data: []byte(response),
 			})
 			if err != nil {
-				return logger.Errorf("failed to send SASL response: %w", err)
+				return log.Errorf("failed to send SASL response: %w", err)
 			}
 
 		case *pgproto3.AuthenticationSASLFinal:
-			logger.Debug("backend SASL final")
+			log.Debug("backend SASL final")
 			if scramConversation == nil {
-				return logger.Errorf("received SASL final without conversation")
+				return log.Errorf("received SASL final without conversation")
 			}
 
+			scramSpan.AddEvent("server-final-message")
 			_, err := scramConversation.Step(string(authMsg.Data))
 			if err != nil {
-				return logger.Errorf("SCRAM final step failed: %w", err)
+				return log.Errorf("SCRAM final step failed: %w", err)
 			}
+			tracing.End(scramSpan, nil)
+			scramSpan = nil
 			// Authentication complete, backend will send AuthenticationOk next
 
 		default:
-			logger.Warn("unexpected backend auth message: %T", authMsg)
+			log.Warn("unexpected backend auth message: %T", authMsg)
 		}
 	}
 }
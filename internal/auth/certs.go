@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+
+	"gprxy/internal/logger"
+)
+
+// certificateIdentities returns the identities a client certificate can be
+// mapped by: its subject common name and every DNS, URI and email SAN, each
+// prefixed with its kind (cn:, dns:, uri:, email:)
+func certificateIdentities(cert *x509.Certificate) []string {
+	var identities []string
+	if cert.Subject.CommonName != "" {
+		identities = append(identities, "cn:"+cert.Subject.CommonName)
+	}
+	for _, name := range cert.DNSNames {
+		identities = append(identities, "dns:"+strings.ToLower(name))
+	}
+	for _, uri := range cert.URIs {
+		identities = append(identities, "uri:"+uri.String())
+	}
+	for _, email := range cert.EmailAddresses {
+		identities = append(identities, "email:"+strings.ToLower(email))
+	}
+	return identities
+}
+
+// loadCertMappings loads CERT_MAPPING_<ROLE>=identity[,identity...] variables
+// mapping client certificate identities to roles
+func (rm *RoleMapper) loadCertMappings() error {
+	for _, env := range os.Environ() {
+		if !strings.HasPrefix(env, "CERT_MAPPING_") {
+			continue
+		}
+		parts := strings.SplitN(env, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		role := strings.ToLower(strings.TrimPrefix(parts[0], "CERT_MAPPING_"))
+		if _, exists := rm.roleToAccount[role]; !exists {
+			return fmt.Errorf("%s refers to role %s without a ROLE_MAPPING_%s", parts[0], role, strings.ToUpper(role))
+		}
+
+		for _, identity := range strings.Split(parts[1], ",") {
+			identity = normalizeIdentity(identity)
+			if identity == "" {
+				continue
+			}
+			if !strings.HasPrefix(identity, "cn:") && !strings.HasPrefix(identity, "dns:") &&
+				!strings.HasPrefix(identity, "uri:") && !strings.HasPrefix(identity, "email:") {
+				return fmt.Errorf("invalid certificate identity %q for role %s (expected cn:, dns:, uri: or email: prefix)", identity, role)
+			}
+			if other, exists := rm.certToRole[identity]; exists && other != role {
+				return fmt.Errorf("certificate identity %q is mapped to both role %s and %s", identity, other, role)
+			}
+			rm.certToRole[identity] = role
+			logger.Info("Loaded certificate mapping: %s → %s", identity, role)
+		}
+	}
+	return nil
+}
+
+// normalizeIdentity lower-cases the case-insensitive parts of an identity so
+// configured values match certificateIdentities
+func normalizeIdentity(identity string) string {
+	identity = strings.TrimSpace(identity)
+	kind, value, found := strings.Cut(identity, ":")
+	if !found {
+		return identity
+	}
+	kind = strings.ToLower(kind)
+	if kind == "dns" || kind == "email" {
+		value = strings.ToLower(value)
+	}
+	return kind + ":" + value
+}
+
+// MapCertificateToServiceAccount maps a verified client certificate to a
+// PostgreSQL service account through the first of its identities that has a
+// CERT_MAPPING_<ROLE> entry. Unlike token roles there is no default role:
+// unmapped certificates are refused so the client falls back to a password.
+func (rm *RoleMapper) MapCertificateToServiceAccount(log *logger.Logger, cert *x509.Certificate) (*ServiceAccount, error) {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+
+	identities := certificateIdentities(cert)
+	for _, identity := range identities {
+		role, exists := rm.certToRole[identity]
+		if !exists {
+			continue
+		}
+		account := rm.roleToAccount[role]
+		log.Debug("Mapped certificate identity '%s' to role '%s' (service account '%s')", identity, role, account.Username)
+		return &account, nil
+	}
+	return nil, fmt.Errorf("no role mapped for certificate identities %v", identities)
+}
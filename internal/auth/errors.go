@@ -7,7 +7,7 @@ import (
 )
 
 // sendErrorToClient sends an error message to the client
-func sendErrorToClient(cb *pgproto3.Backend, msg string) error {
+func sendErrorToClient(log *logger.Logger, cb *pgproto3.Backend, msg string) error {
 	errMsg := &pgproto3.ErrorResponse{
 		Severity: "FATAL",
 		Code:     "08006",
@@ -15,7 +15,7 @@ func sendErrorToClient(cb *pgproto3.Backend, msg string) error {
 	}
 	err := cb.Send(errMsg)
 	if err != nil {
-		return logger.Errorf("failed to send error to client: %w", err)
+		return log.Errorf("failed to send error to client: %w", err)
 	}
-	return logger.Errorf("%s", msg)
+	return log.Errorf("%s", msg)
 }
@@ -5,6 +5,8 @@ import (
 	"crypto/rsa"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 
 	"math/big"
 	"net/http"
@@ -12,8 +14,13 @@ import (
 	"time"
 
 	"gprxy/internal/logger"
+	"gprxy/internal/metrics"
+	"gprxy/internal/tracing"
 
 	"github.com/golang-jwt/jwt/v5"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
 )
 
 type JWTValidator struct {
@@ -23,6 +30,7 @@ type JWTValidator struct {
 	publicKeys    map[string]*rsa.PublicKey
 	keysMutex     sync.RWMutex
 	lastKeysFetch time.Time
+	keysFetch     singleflight.Group // Shares one JWKS request among concurrent refreshes
 	keysCacheTTL  time.Duration
 	httpClient    *http.Client
 }
@@ -62,25 +70,28 @@ func NewJWTValidator(issuer, audience, jwksURL string) *JWTValidator {
 	}
 }
 
-func (v *JWTValidator) ValidateJWT(authToken string) (*OAuthContext, error) {
+func (v *JWTValidator) ValidateJWT(ctx context.Context, log *logger.Logger, authToken string) (_ *OAuthContext, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "auth.jwt.validate")
+	defer func() { tracing.End(span, err) }()
+
 	token, err := jwt.Parse(authToken, func(t *jwt.Token) (interface{}, error) {
 
 		// parse and validate the algo
 		if t.Method.Alg() != jwt.SigningMethodRS256.Alg() {
-			return nil, logger.Errorf("unexpected signing method: %v ", t.Header["alg"])
+			return nil, log.Errorf("unexpected signing method: %v ", t.Header["alg"])
 		}
 
 		// get key id from token header
 
 		kid, ok := t.Header["kid"].(string)
 		if !ok {
-			return nil, logger.Errorf("key id (kid) not found in token header")
+			return nil, log.Errorf("key id (kid) not found in token header")
 		}
 
 		// get pub key
-		publicKey, err := v.getPublicKey(kid)
+		publicKey, err := v.getPublicKey(ctx, log, kid)
 		if err != nil {
-			return nil, logger.Errorf("failed to get public key: %v", err)
+			return nil, log.Errorf("failed to get public key: %v", err)
 		}
 
 		return publicKey, nil
@@ -88,18 +99,21 @@ func (v *JWTValidator) ValidateJWT(authToken string) (*OAuthContext, error) {
 	}, jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg()}))
 
 	if err != nil {
-		return nil, logger.Errorf("jwt validation failed:%v", err)
+		recordJWTFailure(parseFailureReason(err))
+		return nil, log.Errorf("jwt validation failed:%v", err)
 	}
 
 	if !token.Valid {
-		return nil, logger.Errorf("jwt token invalid: %v", err)
+		recordJWTFailure("invalid")
+		return nil, log.Errorf("jwt token invalid: %v", err)
 	}
 
 	// Extract claims
 
 	claims, ok := token.Claims.(jwt.MapClaims)
 	if !ok {
-		return nil, logger.Errorf("failed to parse jwt claims")
+		recordJWTFailure("malformed")
+		return nil, log.Errorf("failed to parse jwt claims")
 	}
 
 	// validate issuer
@@ -107,11 +121,13 @@ func (v *JWTValidator) ValidateJWT(authToken string) (*OAuthContext, error) {
 	iss, ok := claims["iss"].(string)
 
 	if !ok || iss != v.issuer {
-		return nil, logger.Errorf("invalid issue: %v", err)
+		recordJWTFailure("issuer")
+		return nil, log.Errorf("invalid issue: %v", err)
 	}
 
 	// validate audience
-	if err := v.validateAudience(claims); err != nil {
+	if err := v.validateAudience(log, claims); err != nil {
+		recordJWTFailure("audience")
 		return nil, err
 	}
 
@@ -122,7 +138,8 @@ func (v *JWTValidator) ValidateJWT(authToken string) (*OAuthContext, error) {
 
 	email, ok := claims["email"].(string)
 	if !ok || email == "" {
-		return nil, logger.Errorf("email not found in jwt")
+		recordJWTFailure("missing_claim")
+		return nil, log.Errorf("email not found in jwt")
 	}
 
 	oauthContext.Email = email
@@ -131,7 +148,8 @@ func (v *JWTValidator) ValidateJWT(authToken string) (*OAuthContext, error) {
 
 	sub, ok := claims["sub"].(string)
 	if !ok || sub == "" {
-		return nil, logger.Errorf("sub claim not found in jwt")
+		recordJWTFailure("missing_claim")
+		return nil, log.Errorf("sub claim not found in jwt")
 	}
 	oauthContext.Subject = sub
 
@@ -151,13 +169,37 @@ func (v *JWTValidator) ValidateJWT(authToken string) (*OAuthContext, error) {
 
 	// Validate expiration
 	if time.Now().After(oauthContext.ExpiresAt) {
-		return nil, logger.Errorf("JWT token has expired")
+		recordJWTFailure("expired")
+		return nil, log.Errorf("JWT token has expired")
 	}
 
-	logger.Debug("JWT validated successfully for user: %s (roles: %v)", oauthContext.Email, oauthContext.Roles)
+	log.Debug("JWT validated successfully for user: %s (roles: %v)", oauthContext.Email, oauthContext.Roles)
 	return oauthContext, nil
 
 }
+
+// parseFailureReason classifies a jwt.Parse error for the failure metric
+func parseFailureReason(err error) string {
+	switch {
+	case errors.Is(err, jwt.ErrTokenExpired):
+		return "expired"
+	case errors.Is(err, jwt.ErrTokenNotValidYet), errors.Is(err, jwt.ErrTokenUsedBeforeIssued):
+		return "not_yet_valid"
+	case errors.Is(err, jwt.ErrTokenMalformed):
+		return "malformed"
+	case errors.Is(err, jwt.ErrTokenSignatureInvalid):
+		return "signature"
+	case errors.Is(err, jwt.ErrTokenUnverifiable):
+		// The key lookup failed, e.g. unknown kid or JWKS unavailable
+		return "unverifiable"
+	}
+	return "invalid"
+}
+
+func recordJWTFailure(reason string) {
+	metrics.JWTValidationFailures.WithLabelValues(reason).Inc()
+}
+
 func (v *JWTValidator) extractRoles(claims jwt.MapClaims) []string {
 	roles := []string{}
 
@@ -191,16 +233,16 @@ func (v *JWTValidator) extractRoles(claims jwt.MapClaims) []string {
 
 	return roles
 }
-func (v *JWTValidator) validateAudience(claims jwt.MapClaims) error {
+func (v *JWTValidator) validateAudience(log *logger.Logger, claims jwt.MapClaims) error {
 	aud, ok := claims["aud"]
 	if !ok {
-		return logger.Errorf("aud claim not found in jwt")
+		return log.Errorf("aud claim not found in jwt")
 	}
 
 	switch audience := aud.(type) {
 	case string:
 		if audience != v.audience {
-			return logger.Errorf("invalid audience expected: %v, got: %v", v.audience, audience)
+			return log.Errorf("invalid audience expected: %v, got: %v", v.audience, audience)
 		}
 
 	case []interface{}:
@@ -214,80 +256,122 @@ func (v *JWTValidator) validateAudience(claims jwt.MapClaims) error {
 		}
 
 		if !found {
-			return logger.Errorf("invalid audience: %s not found in audience list", v.audience)
+			return log.Errorf("invalid audience: %s not found in audience list", v.audience)
 		}
 	default:
-		return logger.Errorf("invalid audience type: %v", audience)
+		return log.Errorf("invalid audience type: %v", audience)
 	}
 	return nil
 }
 
-func (v *JWTValidator) getPublicKey(kid string) (*rsa.PublicKey, error) {
+func (v *JWTValidator) getPublicKey(ctx context.Context, log *logger.Logger, kid string) (*rsa.PublicKey, error) {
 	v.keysMutex.RLock()
+	key, exists := v.publicKeys[kid]
+	fresh := time.Since(v.lastKeysFetch) < v.keysCacheTTL
+	v.keysMutex.RUnlock()
 
-	if key, exists := v.publicKeys[kid]; exists {
-		// check if still valid
+	// check if still valid
+	if exists && fresh {
+		return key, nil
+	}
 
-		if time.Since(v.lastKeysFetch) < v.keysCacheTTL {
-			v.keysMutex.RUnlock()
+	// fetch new keys; the lock is only taken to swap them in, so other
+	// logins are not held up by a slow JWKS endpoint
+	log.Debug("fetching jwks from %s", v.jwksURL)
+	if err := v.refreshJWKS(ctx, log); err != nil {
+		if exists {
+			log.Warn("using stale JWKS key due to fetch failure")
 			return key, nil
 		}
+		return nil, err
 	}
 
+	v.keysMutex.RLock()
+	key, exists = v.publicKeys[kid]
 	v.keysMutex.RUnlock()
+	if !exists {
+		return nil, log.Errorf("public key with kid %s not found in JWKS", kid)
+	}
 
-	// fetch new keys
-	v.keysMutex.Lock()
-	defer v.keysMutex.Unlock()
+	return key, nil
+}
 
-	if key, exists := v.publicKeys[kid]; exists && time.Since(v.lastKeysFetch) < v.keysCacheTTL {
-		return key, nil
+// CheckJWKS is a readiness check: the JWKS cache must hold keys fetched within
+// the cache TTL. An empty or stale cache is refreshed first, so a new proxy
+// becomes ready without waiting for the first token.
+func CheckJWKS(ctx context.Context) (any, error) {
+	if jwtValidator == nil {
+		return nil, errors.New("authentication is not initialized")
 	}
+	return jwtValidator.checkKeys(ctx)
+}
 
-	logger.Debug("fetching jwks from %s", v.jwksURL)
-	if err := v.fetchJWKS(); err != nil {
-		if key, exists := v.publicKeys[kid]; exists {
-			logger.Warn("using stale JWKS key due to fetch failure")
-			return key, nil
-		}
-		return nil, err
+func (v *JWTValidator) checkKeys(ctx context.Context) (any, error) {
+	v.keysMutex.RLock()
+	fresh := len(v.publicKeys) > 0 && time.Since(v.lastKeysFetch) < v.keysCacheTTL
+	v.keysMutex.RUnlock()
+
+	var refreshErr error
+	if !fresh {
+		refreshErr = v.refreshJWKS(ctx, logger.With("check", "jwks"))
 	}
-	key, exists := v.publicKeys[kid]
-	if !exists {
-		return nil, logger.Errorf("public key with kid %s not found in JWKS", kid)
+
+	v.keysMutex.RLock()
+	defer v.keysMutex.RUnlock()
+	detail := map[string]any{"url": v.jwksURL, "keys": len(v.publicKeys)}
+	if !v.lastKeysFetch.IsZero() {
+		detail["fetched_at"] = v.lastKeysFetch.UTC().Format(time.RFC3339)
+	}
+	if refreshErr != nil {
+		return detail, fmt.Errorf("JWKS refresh failed: %w", refreshErr)
 	}
+	if len(v.publicKeys) == 0 {
+		return detail, errors.New("JWKS holds no RSA signing keys")
+	}
+	return detail, nil
+}
 
-	return key, nil
+// refreshJWKS replaces the cached keys with the current JWKS. Callers arriving
+// while a fetch is in flight wait for it instead of starting their own.
+func (v *JWTValidator) refreshJWKS(ctx context.Context, log *logger.Logger) error {
+	_, err, _ := v.keysFetch.Do(v.jwksURL, func() (any, error) {
+		return nil, v.fetchJWKS(ctx, log)
+	})
+	return err
 }
 
-func (v *JWTValidator) fetchJWKS() error {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+func (v *JWTValidator) fetchJWKS(ctx context.Context, log *logger.Logger) (err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "auth.jwks.fetch", trace.WithAttributes(attribute.String("url.full", v.jwksURL)))
+	defer func() { tracing.End(span, err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
 
 	req, err := http.NewRequestWithContext(ctx, "GET", v.jwksURL, nil)
 	if err != nil {
-		return logger.Errorf("failed to create JWKS request: %v", err)
+		return log.Errorf("failed to create JWKS request: %v", err)
 	}
 
 	response, err := v.httpClient.Do(req)
 
 	if err != nil {
-		return logger.Errorf("failed to fetch JWKS: %w", err)
+		return log.Errorf("failed to fetch JWKS: %w", err)
 	}
 
 	defer response.Body.Close()
 
 	if response.StatusCode != http.StatusOK {
-		return logger.Errorf("jwks endpoint returned %v", response.StatusCode)
+		return log.Errorf("jwks endpoint returned %v", response.StatusCode)
 	}
 
 	var jwks JWKS
 	if err := json.NewDecoder(response.Body).Decode(&jwks); err != nil {
-		return logger.Errorf("failed to decode jwks: %v", err)
+		return log.Errorf("failed to decode jwks: %v", err)
 	}
 
 	// Parse Keys
 
+	keys := make(map[string]*rsa.PublicKey, len(jwks.Keys))
 	for _, jwk := range jwks.Keys {
 		if jwk.Kty != "RSA" || jwk.Use != "sig" {
 			continue
@@ -297,13 +381,13 @@ func (v *JWTValidator) fetchJWKS() error {
 		// decoding modulus - The RSA modulus, base64url-encoded. One half of the RSA public key.
 		nBytes, err := base64.RawURLEncoding.DecodeString(jwk.N)
 		if err != nil {
-			return logger.Errorf("failed to decode n: %v", err)
+			return log.Errorf("failed to decode n: %v", err)
 		}
 
 		// decoding exponent (e)
 		eBytes, err := base64.RawURLEncoding.DecodeString(jwk.E)
 		if err != nil {
-			return logger.Errorf("failed to decode e: %v", err)
+			return log.Errorf("failed to decode e: %v", err)
 		}
 
 		pubKey := &rsa.PublicKey{
@@ -317,14 +401,38 @@ func (v *JWTValidator) fetchJWKS() error {
 			pubKey.E = pubKey.E<<8 + int(b)
 		}
 
-		v.publicKeys[jwk.Kid] = pubKey
+		keys[jwk.Kid] = pubKey
 
-		logger.Debug("loaded public key: kid=%s, alg=%s", jwk.Kid, jwk.Alg)
+		log.Debug("loaded public key: kid=%s, alg=%s", jwk.Kid, jwk.Alg)
 
 	}
-	v.lastKeysFetch = time.Now()
 
-	logger.Info("loaded %d public keys from JWKS", len(v.publicKeys))
+	v.keysMutex.Lock()
+	changed := !sameKeyIDs(v.publicKeys, keys)
+	v.publicKeys = keys
+	v.lastKeysFetch = time.Now()
+	v.keysMutex.Unlock()
+
+	// Periodic refreshes usually return the same keys; only a rotation is
+	// worth reporting
+	if changed {
+		log.Info("loaded %d public keys from JWKS", len(keys))
+	} else {
+		log.Debug("refreshed %d public keys from JWKS", len(keys))
+	}
 
 	return nil
 }
+
+// sameKeyIDs reports whether two key sets hold the same key IDs
+func sameKeyIDs(a, b map[string]*rsa.PublicKey) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for kid := range a {
+		if _, ok := b[kid]; !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -12,6 +12,7 @@ import (
 // RoleMapper maps OAuth roles to PostgreSQL service accounts
 type RoleMapper struct {
 	roleToAccount map[string]ServiceAccount
+	certToRole    map[string]string // Client certificate identity to role, see certificateIdentities
 	defaultRole   string
 	mu            sync.RWMutex
 }
@@ -27,6 +28,7 @@ type ServiceAccount struct {
 func NewRoleMapper() (*RoleMapper, error) {
 	mapper := &RoleMapper{
 		roleToAccount: make(map[string]ServiceAccount),
+		certToRole:    make(map[string]string),
 		defaultRole:   os.Getenv("DEFAULT_ROLE"),
 	}
 
@@ -40,6 +42,10 @@ func NewRoleMapper() (*RoleMapper, error) {
 		return nil, fmt.Errorf("no role mappings configured")
 	}
 
+	if err := mapper.loadCertMappings(); err != nil {
+		return nil, err
+	}
+
 	return mapper, nil
 }
 
@@ -97,30 +103,30 @@ func (rm *RoleMapper) loadFromEnvironment() error {
 }
 
 // MapRoleToServiceAccount maps user roles to a PostgreSQL service account
-func (rm *RoleMapper) MapRoleToServiceAccount(roles []string) (*ServiceAccount, error) {
+func (rm *RoleMapper) MapRoleToServiceAccount(log *logger.Logger, roles []string) (*ServiceAccount, error) {
 	rm.mu.RLock()
 	defer rm.mu.RUnlock()
 
 	if len(roles) == 0 {
-		return rm.handleNoRoles()
+		return rm.handleNoRoles(log)
 	}
 
 	// Try each role in order (first match wins)
 	for _, role := range roles {
 		normalizedRole := strings.ToLower(strings.TrimSpace(role))
 		if account, exists := rm.roleToAccount[normalizedRole]; exists {
-			logger.Debug("Mapped role '%s' to service account '%s'", role, account.Username)
+			log.Debug("Mapped role '%s' to service account '%s'", role, account.Username)
 			return &account, nil
 		}
 	}
 
 	// No matching role found
-	logger.Warn("No service account found for roles: %v", roles)
-	return rm.handleNoRoles()
+	log.Warn("No service account found for roles: %v", roles)
+	return rm.handleNoRoles(log)
 }
 
 // handleNoRoles returns the default role's service account or an error
-func (rm *RoleMapper) handleNoRoles() (*ServiceAccount, error) {
+func (rm *RoleMapper) handleNoRoles(log *logger.Logger) (*ServiceAccount, error) {
 	if rm.defaultRole == "" {
 		return nil, fmt.Errorf("user has no valid roles and no default role configured")
 	}
@@ -130,7 +136,7 @@ func (rm *RoleMapper) handleNoRoles() (*ServiceAccount, error) {
 		return nil, fmt.Errorf("default role '%s' not found in role mappings", rm.defaultRole)
 	}
 
-	logger.Debug("Using default service account '%s'", account.Username)
+	log.Debug("Using default service account '%s'", account.Username)
 	return &account, nil
 }
 
@@ -1,24 +1,30 @@
 package cli
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"gprxy/internal/logger"
-	"gprxy/internal/tls"
 
-	"github.com/jackc/pgproto3/v2"
 	"github.com/joho/godotenv"
 	"github.com/spf13/cobra"
 )
 
 type ConnectionConfig struct {
-	db_name string
-	db_host string
-	db_port int
+	db_name  string
+	db_host  string
+	db_port  int
+	ca_file  string
+	pin      string
+	insecure bool
+	listen   string
+	exec     string
 }
 
 var connectConfig ConnectionConfig
@@ -27,11 +33,15 @@ func init() {
 	godotenv.Load(".env")
 	flags := oidc_connect.Flags()
 	flags.StringVarP(&connectConfig.db_host, "host", "s", "", "DB hostname or ip")
-	flags.StringVarP(&connectConfig.db_name, "database", "d", "", "DB name")
+	flags.StringVarP(&connectConfig.db_name, "database", "d", "", "DB name (default: the database the local client asks for)")
 	flags.IntVarP(&connectConfig.db_port, "port", "p", 5432, "DB port")
+	flags.StringVar(&connectConfig.ca_file, "ca-file", os.Getenv("PROXY_CA_FILE"), "CA bundle to verify the proxy certificate (default: system roots)")
+	flags.StringVar(&connectConfig.pin, "pin-sha256", os.Getenv("PROXY_CERT_SHA256"), "Expected SHA-256 fingerprint of the proxy certificate")
+	flags.StringVarP(&connectConfig.listen, "listen", "l", "127.0.0.1:6432", "Local address or Unix socket path for libpq clients")
+	flags.StringVar(&connectConfig.exec, "exec", "", "Command to run against the tunnel (e.g. psql); arguments follow --")
+	flags.BoolVar(&connectConfig.insecure, "insecure", false, "Send the access token even if the proxy does not support TLS")
 
 	oidc_connect.MarkFlagRequired("host")
-	oidc_connect.MarkFlagRequired("database")
 
 	rootCommand.AddCommand(oidc_connect)
 }
@@ -39,7 +49,19 @@ func init() {
 var oidc_connect = &cobra.Command{
 	Use:   "connect",
 	Short: "Connect to the db requested by user via oidc",
-	Run:   connect,
+	Long: `Open a local listener that psql and other libpq clients can connect to
+without a password. Each session is relayed to the proxy over TLS using the
+cached access token from ~/.gprxy/credentials.
+
+  gprxy connect -s <db_host> -d orders
+  psql "host=127.0.0.1 port=6432 dbname=orders"
+
+With --exec the command runs with PGHOST, PGPORT, PGUSER and PGDATABASE set to
+the tunnel, which closes again when the command exits:
+
+  gprxy connect -s <db_host> -d orders --exec psql -- -c 'select 1'
+`,
+	Run: connect,
 }
 
 func (connectConfig *ConnectionConfig) Validate() error {
@@ -68,7 +90,7 @@ func (connectConfig *ConnectionConfig) Validate() error {
 func getCreds() (*SavedCreds, error) {
 	creds, err := loadCreds()
 	if err != nil {
-		logger.Error("Unable to load creds", err)
+		return nil, logger.Errorf("unable to load creds, run 'gprxy login': %v", err)
 	}
 	logger.Debug("loaded access token from ~/.gprxy/credentials")
 
@@ -92,53 +114,38 @@ func connect(cmd *cobra.Command, args []string) {
 		logger.Error("configuration error: %v", err)
 
 	}
-	logger.Info("Connecting to %s:%d/%s",
-		connectConfig.db_host,
-		connectConfig.db_port,
-		connectConfig.db_name)
 
-	// read auth file if it exists
+	// Fail early if the user is not logged in
 	creds, err := getCreds()
 	if err != nil {
 		logger.Fatal("Failed to get credentials: %v", err)
 		return
 	}
-	proxy_url := net.JoinHostPort(os.Getenv("PROXY_URL"), "7777")
-	conn, err := net.DialTimeout("tcp", proxy_url, 5*time.Second)
-	if err != nil {
-		logger.Error("trouble establishing connnection to the proxy: %v", err)
-	}
-	defer conn.Close()
 
-	conn, err = tls.UpgradeToTLS(conn, os.Getenv("PROXY_URL"))
+	ln, err := listenLocal(connectConfig.listen)
 	if err != nil {
-		logger.Fatal("TLS upgrade failed: %v", err)
+		logger.Fatal("%v", err)
+		return
 	}
+	defer ln.Close()
 
-	proxyConnection := pgproto3.NewFrontend(pgproto3.NewChunkReader(conn), conn)
-	startupMessage := &pgproto3.StartupMessage{
-		ProtocolVersion: pgproto3.ProtocolVersionNumber,
-		Parameters: map[string]string{
-			"application_name": "psql",
-			"client_encoding":  "UTF8",
-			"database":         connectConfig.db_name,
-			"user":             creds.UserInfo.Email,
-		},
+	database := connectConfig.db_name
+	if database == "" {
+		database = "<requested by client>"
 	}
-	err = proxyConnection.Send(startupMessage)
-	if err != nil {
-		logger.Error("failed to send startup message: %v", err)
-	}
-
-	msg, _ := proxyConnection.Receive()
-
-	logger.Debug("proxy sent back: %v", msg)
+	logger.Info("Listening on %s, relaying to %s:%d/%s through the proxy",
+		ln.Addr(),
+		connectConfig.db_host,
+		connectConfig.db_port,
+		database)
 
-	pmsg := &pgproto3.PasswordMessage{
-		Password: creds.AccessToken,
+	if connectConfig.exec != "" {
+		code := runChild(ln, connectConfig.exec, args, creds.UserInfo.Email)
+		ln.Close()
+		os.Exit(code)
 	}
-	err = proxyConnection.Send(pmsg)
-	if err != nil {
-		logger.Error("failed to send pmsg message: %v", err)
-	}
-}
\ No newline at end of file
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	serveLocal(ctx, ln)
+}
@@ -0,0 +1,120 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"gprxy/internal/logger"
+)
+
+// tunnelEnv returns libpq environment variables pointing at the local listener
+func tunnelEnv(ln net.Listener, user string) ([]string, error) {
+	var host, port string
+	switch addr := ln.Addr().(type) {
+	case *net.TCPAddr:
+		host = addr.IP.String()
+		port = strconv.Itoa(addr.Port)
+	case *net.UnixAddr:
+		// libpq finds a socket as <PGHOST>/.s.PGSQL.<PGPORT>
+		dir, name := filepath.Split(addr.Name)
+		if !strings.HasPrefix(name, ".s.PGSQL.") {
+			return nil, logger.Errorf("--exec needs a Unix socket named .s.PGSQL.<port>, got %s", name)
+		}
+		// A host starting with '/' is what tells libpq to use a socket
+		absDir, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, logger.Errorf("failed to resolve socket directory: %w", err)
+		}
+		host = absDir
+		port = strings.TrimPrefix(name, ".s.PGSQL.")
+	default:
+		return nil, logger.Errorf("unsupported listener address %s", ln.Addr())
+	}
+
+	env := []string{
+		"PGHOST=" + host,
+		"PGPORT=" + port,
+		"PGUSER=" + user,
+	}
+	if connectConfig.db_name != "" {
+		env = append(env, "PGDATABASE="+connectConfig.db_name)
+	}
+	return env, nil
+}
+
+// runChild runs the --exec command against the tunnel and serves local
+// sessions until it exits. Signals sent to gprxy are forwarded to the child
+// instead of stopping the tunnel under it. It returns the child's exit code.
+func runChild(ln net.Listener, name string, args []string, user string) int {
+	env, err := tunnelEnv(ln, user)
+	if err != nil {
+		logger.Error("%v", err)
+		return 1
+	}
+
+	child := exec.Command(name, args...)
+	child.Stdin = os.Stdin
+	child.Stdout = os.Stdout
+	child.Stderr = os.Stderr
+	child.Env = append(os.Environ(), env...)
+
+	// Catch signals before starting the child so none can kill the tunnel
+	// while it runs
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT)
+	defer signal.Stop(signals)
+
+	if err := child.Start(); err != nil {
+		logger.Error("failed to start %s: %v", name, err)
+		return 1
+	}
+	logger.Debug("started %s (pid %d) with %v", name, child.Process.Pid, env)
+
+	ctx, stop := context.WithCancel(context.Background())
+	served := make(chan struct{})
+	go func() {
+		serveLocal(ctx, ln)
+		close(served)
+	}()
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- child.Wait()
+	}()
+
+	var waitErr error
+	for running := true; running; {
+		select {
+		case sig := <-signals:
+			// A terminal Ctrl-C reaches the child directly as well; psql
+			// treats the extra SIGINT as another query cancel, which is
+			// harmless
+			logger.Debug("forwarding %v to %s", sig, name)
+			child.Process.Signal(sig)
+		case waitErr = <-exited:
+			running = false
+		}
+	}
+
+	// The child has exited, so tear the tunnel down
+	stop()
+	<-served
+
+	var exitErr *exec.ExitError
+	if errors.As(waitErr, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	if waitErr != nil {
+		logger.Error("%s failed: %v", name, waitErr)
+		return 1
+	}
+	return 0
+}
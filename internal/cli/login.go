@@ -184,7 +184,7 @@ func startCallbackServer(ctx context.Context, session *OAuthSession) (string, er
                 </html>
             `, errorParam)
 
-			errChan <- logger.Errorf(errorParam + errorDesc)
+			errChan <- logger.Errorf("%s%s", errorParam, errorDesc)
 			return
 		}
 
@@ -193,14 +193,14 @@ func startCallbackServer(ctx context.Context, session *OAuthSession) (string, er
 		if code == "" {
 			http.Error(w, "missing auth code", http.StatusBadRequest)
 			errorMessage := "missing authorisation code in callback"
-			logger.Error(errorMessage)
+			logger.Error("%s", errorMessage)
 			errChan <- errors.New(errorMessage)
 		}
 
 		if state == "" {
 			http.Error(w, "Missing state parameter", http.StatusBadRequest)
 			errorMessage := "missing state param in callback"
-			logger.Error(errorMessage)
+			logger.Error("%s", errorMessage)
 			errChan <- errors.New(errorMessage)
 		}
 
@@ -212,7 +212,7 @@ func startCallbackServer(ctx context.Context, session *OAuthSession) (string, er
 		if state != expectedState {
 			http.Error(w, "Invalid state parameter", http.StatusBadRequest)
 			errorMessage := "state mismatch - possible CSRF attack"
-			logger.Error(errorMessage)
+			logger.Error("%s", errorMessage)
 			errChan <- errors.New(errorMessage)
 		}
 
@@ -242,7 +242,7 @@ func startCallbackServer(ctx context.Context, session *OAuthSession) (string, er
 	go func() {
 		logger.Info("Starting local callback server on localhost:8085")
 		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			logger.Error("callback server error: %w", err)
+			logger.Error("callback server error: %v", err)
 			errChan <- errors.New(err.Error())
 		}
 	}()
@@ -77,7 +77,7 @@ func isExpired(creds *SavedCreds) bool {
 func loginStatus() bool {
 	creds, err := loadCreds()
 	if err != nil {
-		logger.Error("Unable to load creds", err)
+		logger.Error("Unable to load creds: %v", err)
 		return false
 	}
 	if isExpired(creds) {
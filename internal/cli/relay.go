@@ -0,0 +1,242 @@
+package cli
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gprxy/internal/logger"
+	"gprxy/internal/tls"
+
+	"github.com/jackc/pgproto3/v2"
+)
+
+// Local relay for `gprxy connect`: libpq clients connect to a local TCP port or
+// Unix socket without a password, the CLI opens a TLS connection to the proxy,
+// answers the proxy's password request with the cached access token and then
+// relays the session byte for byte.
+
+// listenLocal opens the local listener. Addresses starting with '/' or '.' are
+// Unix socket paths; anything else is a TCP host:port.
+func listenLocal(address string) (net.Listener, error) {
+	if strings.HasPrefix(address, "/") || strings.HasPrefix(address, ".") {
+		// A socket left behind by a previous run would make Listen fail
+		if info, err := os.Stat(address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(address)
+		}
+		ln, err := net.Listen("unix", address)
+		if err != nil {
+			return nil, logger.Errorf("failed to listen on %s: %w", address, err)
+		}
+		// Only the current user may borrow their token
+		if err := os.Chmod(address, 0o600); err != nil {
+			ln.Close()
+			return nil, logger.Errorf("failed to restrict socket permissions: %w", err)
+		}
+		return ln, nil
+	}
+
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, logger.Errorf("failed to listen on %s: %w", address, err)
+	}
+	return ln, nil
+}
+
+// serveLocal accepts local clients until ctx is cancelled and waits for their
+// sessions to finish
+func serveLocal(ctx context.Context, ln net.Listener) {
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	var wg sync.WaitGroup
+	for {
+		local, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			logger.Error("failed to accept local connection: %v", err)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer local.Close()
+			if err := handleLocalClient(local); err != nil {
+				logger.Error("local session ended: %v", err)
+			}
+		}()
+	}
+
+	logger.Info("listener closed, waiting for %s sessions to finish", ln.Addr())
+	wg.Wait()
+}
+
+// dialProxy opens a verified TLS connection to the proxy
+func dialProxy() (net.Conn, error) {
+	proxy_url := net.JoinHostPort(os.Getenv("PROXY_URL"), "7777")
+	conn, err := net.DialTimeout("tcp", proxy_url, 5*time.Second)
+	if err != nil {
+		return nil, logger.Errorf("trouble establishing connnection to the proxy: %w", err)
+	}
+
+	tlsConn, err := tls.UpgradeToTLS(conn, tls.ClientOptions{
+		ServerName:    os.Getenv("PROXY_URL"),
+		CAFile:        connectConfig.ca_file,
+		PinSHA256:     connectConfig.pin,
+		AllowInsecure: connectConfig.insecure,
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// handleLocalClient negotiates the startup with a local client, authenticates
+// to the proxy on its behalf and relays the session
+func handleLocalClient(local net.Conn) error {
+	localReader := bufio.NewReader(local)
+	client := pgproto3.NewBackend(messageReader{localReader}, local)
+
+	var startup *pgproto3.StartupMessage
+	for startup == nil {
+		msg, err := client.ReceiveStartupMessage()
+		if err != nil {
+			return logger.Errorf("error receiving startup message: %w", err)
+		}
+
+		switch m := msg.(type) {
+		case *pgproto3.SSLRequest, *pgproto3.GSSEncRequest:
+			// The local leg stays on this machine; encryption happens
+			// between the CLI and the proxy
+			if _, err := local.Write([]byte{'N'}); err != nil {
+				return logger.Errorf("failed to answer encryption request: %w", err)
+			}
+		case *pgproto3.CancelRequest:
+			return forwardCancel(m)
+		case *pgproto3.StartupMessage:
+			startup = m
+		default:
+			return logger.Errorf("unexpected startup message: %T", msg)
+		}
+	}
+
+	creds, err := getCreds()
+	if err != nil {
+		client.Send(&pgproto3.ErrorResponse{Severity: "FATAL", Code: "28000", Message: "gprxy: no valid credentials, run 'gprxy login'"})
+		return err
+	}
+
+	// The session runs as the logged-in user; the database comes from the
+	// --database flag or else from the local client
+	params := make(map[string]string, len(startup.Parameters))
+	for name, value := range startup.Parameters {
+		params[name] = value
+	}
+	params["user"] = creds.UserInfo.Email
+	if connectConfig.db_name != "" {
+		params["database"] = connectConfig.db_name
+	}
+	logger.Info("local client connected, opening session to %s as %s", params["database"], params["user"])
+
+	remote, err := dialProxy()
+	if err != nil {
+		client.Send(&pgproto3.ErrorResponse{Severity: "FATAL", Code: "08001", Message: "gprxy: could not connect to the proxy"})
+		return err
+	}
+	defer remote.Close()
+
+	remoteReader := bufio.NewReader(remote)
+	proxyConnection := pgproto3.NewFrontend(messageReader{remoteReader}, remote)
+	err = proxyConnection.Send(&pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      params,
+	})
+	if err != nil {
+		return logger.Errorf("failed to send startup message: %w", err)
+	}
+
+	msg, err := proxyConnection.Receive()
+	if err != nil {
+		return logger.Errorf("failed to receive from proxy: %w", err)
+	}
+	logger.Debug("proxy sent back: %T", msg)
+
+	if _, ok := msg.(*pgproto3.AuthenticationCleartextPassword); ok {
+		err = proxyConnection.Send(&pgproto3.PasswordMessage{Password: creds.AccessToken})
+		if err != nil {
+			return logger.Errorf("failed to send access token: %w", err)
+		}
+	} else {
+		// Anything else (AuthenticationOk, an error) belongs to the client
+		if err := client.Send(msg); err != nil {
+			return logger.Errorf("failed to relay %T to local client: %w", msg, err)
+		}
+	}
+
+	// The rest of the session is copied as raw bytes. Whatever either side
+	// sent beyond the messages read so far (the proxy's ParameterStatus and
+	// ReadyForQuery after a certificate login, say) is still in the buffered
+	// readers and is relayed first.
+	relay(localReader, local, remoteReader, remote)
+	logger.Info("local session closed")
+	return nil
+}
+
+// forwardCancel sends a local client's cancel request to the proxy. The proxy
+// issued the cancel key the client holds, so it is passed through unchanged.
+func forwardCancel(cancel *pgproto3.CancelRequest) error {
+	remote, err := dialProxy()
+	if err != nil {
+		return err
+	}
+	defer remote.Close()
+
+	frontend := pgproto3.NewFrontend(pgproto3.NewChunkReader(remote), remote)
+	if err := frontend.Send(cancel); err != nil {
+		return logger.Errorf("failed to forward cancel request: %w", err)
+	}
+	logger.Debug("cancel request forwarded to proxy")
+	return nil
+}
+
+// messageReader hands pgproto3 exactly the bytes of each message it asks for,
+// leaving anything after them in the buffered reader for the raw relay
+type messageReader struct {
+	r *bufio.Reader
+}
+
+func (m messageReader) Next(n int) ([]byte, error) {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(m.r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// relay copies bytes in both directions until either side closes, reading
+// each side through the buffered reader used during startup
+func relay(localReader io.Reader, local net.Conn, remoteReader io.Reader, remote net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(remote, localReader)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(local, remoteReader)
+		done <- struct{}{}
+	}()
+	<-done
+	local.Close()
+	remote.Close()
+	<-done
+}
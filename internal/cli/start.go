@@ -7,12 +7,16 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"gprxy/internal/admin"
+	"gprxy/internal/audit"
 	"gprxy/internal/auth"
 	"gprxy/internal/config"
 	"gprxy/internal/logger"
 	"gprxy/internal/proxy"
 	"gprxy/internal/tls"
+	"gprxy/internal/tracing"
 
 	"github.com/spf13/cobra"
 )
@@ -45,7 +49,52 @@ func startProxyServer(cmd *cobra.Command, args []string) {
 
 	tlsConfig := tls.Load()
 	cfg := config.Load()
-	server := proxy.NewServer(cfg, tlsConfig)
+	for _, listener := range cfg.Listeners {
+		if listener.TLSMode == config.TLSModeRequire && tlsConfig == nil {
+			log.Fatalf("listener %s requires TLS, which needs PROXY_CERT and PROXY_KEY", listener.Name)
+		}
+	}
+	for _, upstream := range cfg.Upstreams {
+		// Fail at startup rather than on the first login
+		if _, err := tls.LoadUpstream(upstream); err != nil {
+			log.Fatalf("invalid TLS configuration for upstream %s: %v", upstream.Name, err)
+		}
+	}
+	shutdownTracing, err := tracing.Init(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to initialize tracing: %v", err)
+	}
+	defer func() {
+		// Flush the spans of the sessions that ended during the drain
+		flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(flushCtx); err != nil {
+			logger.Warn("failed to flush traces: %v", err)
+		}
+	}()
+	auditLog := audit.Load()
+	defer auditLog.Close()
+	server := proxy.NewServer(cfg, tlsConfig, auditLog)
+	if cfg.AdminAddr != "" {
+		liveness := []admin.Check{
+			{Name: "listener", Run: server.CheckListening},
+		}
+		readiness := []admin.Check{
+			{Name: "listener", Run: server.CheckAccepting},
+			{Name: "upstreams", Run: server.CheckUpstreams},
+			{Name: "jwks", Run: auth.CheckJWKS},
+		}
+		// The admin listener outlives the proxy's drain so probes keep
+		// reporting it as not ready until the last session ends
+		adminCtx, stopAdmin := context.WithCancel(context.Background())
+		defer stopAdmin()
+		adminServer := admin.NewServer(cfg.AdminAddr, liveness, readiness)
+		go func() {
+			if err := adminServer.Start(adminCtx); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
 	if err := server.Start(ctx); err != nil {
 		log.Fatal(err)
 	}
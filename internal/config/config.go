@@ -3,18 +3,55 @@ package config
 import (
 	"fmt"
 	"log"
+	"net"
+	"net/url"
 	"os"
+	"strings"
 
 	"github.com/joho/godotenv"
 )
 
+// PoolMode controls how long a client holds on to a pooled backend connection
+type PoolMode string
+
+const (
+	// PoolModeSession pins one backend to the client for its whole session
+	PoolModeSession PoolMode = "session"
+	// PoolModeTransaction assigns a backend per transaction and releases it
+	// as soon as the backend reports the session idle again
+	PoolModeTransaction PoolMode = "transaction"
+	// PoolModeStatement assigns a backend per statement (or extended-protocol
+	// cycle up to Sync) and refuses explicit transaction blocks
+	PoolModeStatement PoolMode = "statement"
+)
+
+// SharesBackends reports whether clients give their backend back to the pool
+// between requests rather than holding it for the whole session
+func (m PoolMode) SharesBackends() bool {
+	return m == PoolModeTransaction || m == PoolModeStatement
+}
+
+// TLSMode controls whether clients must encrypt their connection to the proxy
+type TLSMode string
+
+const (
+	// TLSModeDisable declines SSLRequest even if a certificate is configured
+	TLSModeDisable TLSMode = "disable"
+	// TLSModeAllow accepts both TLS and plaintext clients
+	TLSModeAllow TLSMode = "allow"
+	// TLSModeRequire refuses plaintext startups outside the exempt networks
+	TLSModeRequire TLSMode = "require"
+)
+
 // Config holds all configuration for the proxy
 type Config struct {
-	ProxyHost   string // Proxy listen address
-	ProxyPort   string // Proxy listen port
-	DBHost      string // PostgreSQL database host
+	Listeners   []*Listener          // Addresses clients connect to, each with its own policy
+	AdminAddr   string               // HTTP admin listener for /metrics; empty disables it
+	Upstreams   map[string]*Upstream // PostgreSQL servers keyed by name
+	PoolMode    PoolMode             // Backend pooling mode (session, transaction or statement)
 	ServiceUser string
 	ServicePass string
+	Routes      []Route // Database routing table, see Route
 }
 
 // Load loads configuration from environment variables
@@ -24,21 +61,28 @@ func Load() *Config {
 		log.Println("No .env file found, using system environment")
 	}
 
-	// Proxy listen configuration
-	proxyHost := os.Getenv("PROXY_HOST")
-	if proxyHost == "" {
-		proxyHost = "0.0.0.0" // Listen on all interfaces by default
+	// PostgreSQL upstreams and the database routing table
+	upstreams, err := loadUpstreams()
+	if err != nil {
+		log.Fatalf("invalid upstream configuration: %v", err)
 	}
-
-	proxyPort := os.Getenv("PROXY_PORT")
-	if proxyPort == "" {
-		proxyPort = "7777"
+	routes, err := loadRoutes(upstreams)
+	if err != nil {
+		log.Fatalf("invalid database routing configuration: %v", err)
+	}
+	listeners, err := loadListeners(upstreams)
+	if err != nil {
+		log.Fatalf("invalid listener configuration: %v", err)
 	}
 
-	// PostgreSQL database host
-	dbHost := os.Getenv("DB_HOST")
-	if dbHost == "" {
-		dbHost = "localhost"
+	// Backend pooling mode
+	poolMode := PoolMode(strings.ToLower(os.Getenv("POOL_MODE")))
+	switch poolMode {
+	case "":
+		poolMode = PoolModeSession
+	case PoolModeSession, PoolModeTransaction, PoolModeStatement:
+	default:
+		log.Fatalf("invalid POOL_MODE %q (expected session, transaction or statement)", poolMode)
 	}
 
 	serviceUser := os.Getenv("GPRXY_USER")
@@ -52,21 +96,76 @@ func Load() *Config {
 	}
 
 	return &Config{
-		ProxyHost:   proxyHost,
-		ProxyPort:   proxyPort,
-		DBHost:      dbHost,
+		Listeners:   listeners,
+		AdminAddr:   os.Getenv("PROXY_ADMIN_ADDR"),
+		Upstreams:   upstreams,
+		PoolMode:    poolMode,
 		ServiceUser: serviceUser,
 		ServicePass: servicePass,
+		Routes:      routes,
 	}
 }
 
-// BuildConnectionString creates a PostgreSQL connection string for a specific database
-func (c *Config) BuildConnectionString(database string) string {
-	return fmt.Sprintf(
-		"postgres://%s:%s@%s:5432/%s",
-		c.ServiceUser,
-		c.ServicePass,
-		c.DBHost,
-		database,
-	)
+// BuildConnectionString creates a PostgreSQL connection string for a specific database on an upstream
+func (c *Config) BuildConnectionString(upstream *Upstream, database string) string {
+	return c.buildConnectionString(upstream, upstream.Address(), database)
+}
+
+// BuildReplicaConnectionStrings creates connection strings for a database on
+// each of an upstream's read replicas
+func (c *Config) BuildReplicaConnectionStrings(upstream *Upstream, database string) []string {
+	connectionStrings := make([]string, 0, len(upstream.Replicas))
+	for _, replica := range upstream.Replicas {
+		connectionStrings = append(connectionStrings, c.buildConnectionString(upstream, replica, database))
+	}
+	return connectionStrings
+}
+
+func (c *Config) buildConnectionString(upstream *Upstream, address, database string) string {
+	connURL := &url.URL{
+		Scheme: "postgres",
+		User:   url.UserPassword(c.ServiceUser, c.ServicePass),
+		Host:   address,
+		Path:   "/" + database,
+	}
+	params := url.Values{}
+	if upstream.SSLMode != "" {
+		params.Set("sslmode", upstream.SSLMode)
+	}
+	if upstream.SSLRootCert != "" {
+		params.Set("sslrootcert", upstream.SSLRootCert)
+	}
+	if upstream.SSLCert != "" {
+		params.Set("sslcert", upstream.SSLCert)
+		params.Set("sslkey", upstream.SSLKey)
+	}
+	connURL.RawQuery = params.Encode()
+	return connURL.String()
+}
+
+// parseNetworks parses a comma separated list of CIDRs or single IP addresses
+func parseNetworks(value string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			entry = fmt.Sprintf("%s/%d", entry, bits)
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
 }
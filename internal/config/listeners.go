@@ -0,0 +1,249 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultListener is the name of the listener built from PROXY_HOST/PROXY_PORT
+const DefaultListener = "default"
+
+// AuthMethods is the set of ways clients may authenticate on a listener
+type AuthMethods struct {
+	JWT         bool // Access token in the password field, mapped to a service account
+	Password    bool // Database password passed through to the upstream
+	Certificate bool // Verified client certificate mapped with CERT_MAPPING_*
+}
+
+// AllAuthMethods accepts every authentication method
+var AllAuthMethods = AuthMethods{JWT: true, Password: true, Certificate: true}
+
+func (m AuthMethods) String() string {
+	var methods []string
+	if m.JWT {
+		methods = append(methods, "jwt")
+	}
+	if m.Password {
+		methods = append(methods, "password")
+	}
+	if m.Certificate {
+		methods = append(methods, "cert")
+	}
+	return strings.Join(methods, ",")
+}
+
+// Listener is an address the proxy accepts clients on, with its own client
+// policy
+type Listener struct {
+	Name       string
+	Network    string       // "tcp" or "unix"
+	Address    string       // host:port, or the socket path for unix listeners
+	SocketMode os.FileMode  // Permissions of a unix socket
+	TLSMode    TLSMode      // Client TLS policy (disable, allow or require)
+	TLSExempt  []*net.IPNet // Client networks allowed in plaintext when TLS is required
+	Auth       AuthMethods  // Authentication methods clients may use
+	Upstream   string       // Upstream serving every client; empty uses the routing table
+}
+
+// TLSExemptAddr reports whether a client address is in one of the networks
+// allowed to connect without TLS
+func (l *Listener) TLSExemptAddr(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range l.TLSExempt {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadListeners builds the default listener from the PROXY_* variables, its
+// Unix socket if PROXY_SOCKET_DIR is set, and any
+// LISTENER_<NAME>=tcp://host:port?tls=require&auth=jwt&upstream=name variables
+func loadListeners(upstreams map[string]*Upstream) ([]*Listener, error) {
+	proxyHost := os.Getenv("PROXY_HOST")
+	if proxyHost == "" {
+		proxyHost = "0.0.0.0" // Listen on all interfaces by default
+	}
+	proxyPort := os.Getenv("PROXY_PORT")
+	if proxyPort == "" {
+		proxyPort = "7777"
+	}
+
+	tlsMode, err := parseTLSMode(os.Getenv("PROXY_TLS_MODE"))
+	if err != nil {
+		return nil, fmt.Errorf("PROXY_TLS_MODE: %w", err)
+	}
+	tlsExempt, err := parseNetworks(os.Getenv("PROXY_TLS_EXEMPT_NETWORKS"))
+	if err != nil {
+		return nil, fmt.Errorf("PROXY_TLS_EXEMPT_NETWORKS: %w", err)
+	}
+	authMethods, err := parseAuthMethods(os.Getenv("PROXY_AUTH_METHODS"))
+	if err != nil {
+		return nil, fmt.Errorf("PROXY_AUTH_METHODS: %w", err)
+	}
+	socketMode, err := parseSocketMode(os.Getenv("PROXY_SOCKET_MODE"))
+	if err != nil {
+		return nil, fmt.Errorf("PROXY_SOCKET_MODE: %w", err)
+	}
+
+	defaultListener := &Listener{
+		Name:      DefaultListener,
+		Network:   "tcp",
+		Address:   net.JoinHostPort(proxyHost, proxyPort),
+		TLSMode:   tlsMode,
+		TLSExempt: tlsExempt,
+		Auth:      authMethods,
+	}
+	listeners := []*Listener{defaultListener}
+
+	// The Unix socket shares the default listener's policy under the
+	// .s.PGSQL.<port> name libpq derives from host=<dir> and port=<port>
+	if socketDir := os.Getenv("PROXY_SOCKET_DIR"); socketDir != "" {
+		socket := *defaultListener
+		socket.Name = DefaultListener + "-socket"
+		socket.Network = "unix"
+		socket.Address = filepath.Join(socketDir, ".s.PGSQL."+proxyPort)
+		socket.SocketMode = socketMode
+		listeners = append(listeners, &socket)
+	}
+
+	// Named listeners are started in name order so logs are stable
+	var names []string
+	values := make(map[string]string)
+	for _, env := range os.Environ() {
+		if !strings.HasPrefix(env, "LISTENER_") {
+			continue
+		}
+		parts := strings.SplitN(env, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		names = append(names, parts[0])
+		values[parts[0]] = parts[1]
+	}
+	sort.Strings(names)
+	for _, env := range names {
+		name := strings.ToLower(strings.TrimPrefix(env, "LISTENER_"))
+		listener, err := parseListener(name, values[env])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", env, err)
+		}
+		listeners = append(listeners, listener)
+	}
+
+	for _, listener := range listeners {
+		if listener.Upstream == "" {
+			continue
+		}
+		if _, exists := upstreams[listener.Upstream]; !exists {
+			return nil, fmt.Errorf("listener %q refers to unknown upstream %q", listener.Name, listener.Upstream)
+		}
+	}
+	return listeners, nil
+}
+
+// parseListener parses a listener definition of the form
+// tcp://host:port or unix:///path/.s.PGSQL.<port>, followed by
+// [?tls=mode][&exempt=cidr,..][&auth=jwt,password,cert][&upstream=name][&mode=0660]
+func parseListener(name, value string) (*Listener, error) {
+	u, err := url.Parse(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listener URL: %w", err)
+	}
+
+	query := u.Query()
+	listener := &Listener{
+		Name:     name,
+		Network:  u.Scheme,
+		Upstream: strings.ToLower(query.Get("upstream")),
+	}
+	switch u.Scheme {
+	case "tcp":
+		if u.Port() == "" {
+			return nil, fmt.Errorf("listener port is required")
+		}
+		listener.Address = u.Host
+	case "unix":
+		if u.Path == "" {
+			return nil, fmt.Errorf("socket path is required")
+		}
+		listener.Address = u.Path
+		if listener.SocketMode, err = parseSocketMode(query.Get("mode")); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q (expected tcp:// or unix://)", u.Scheme)
+	}
+
+	if listener.TLSMode, err = parseTLSMode(query.Get("tls")); err != nil {
+		return nil, err
+	}
+	if listener.TLSExempt, err = parseNetworks(query.Get("exempt")); err != nil {
+		return nil, fmt.Errorf("invalid exempt networks: %w", err)
+	}
+	if listener.Auth, err = parseAuthMethods(query.Get("auth")); err != nil {
+		return nil, err
+	}
+	return listener, nil
+}
+
+// parseTLSMode parses a client TLS policy, defaulting to allow
+func parseTLSMode(value string) (TLSMode, error) {
+	mode := TLSMode(strings.ToLower(value))
+	switch mode {
+	case "":
+		return TLSModeAllow, nil
+	case TLSModeDisable, TLSModeAllow, TLSModeRequire:
+		return mode, nil
+	}
+	return "", fmt.Errorf("invalid TLS mode %q (expected disable, allow or require)", value)
+}
+
+// parseAuthMethods parses a comma separated list of jwt, password and cert,
+// defaulting to all of them
+func parseAuthMethods(value string) (AuthMethods, error) {
+	if strings.TrimSpace(value) == "" {
+		return AllAuthMethods, nil
+	}
+
+	var methods AuthMethods
+	for _, method := range strings.Split(value, ",") {
+		switch strings.ToLower(strings.TrimSpace(method)) {
+		case "jwt":
+			methods.JWT = true
+		case "password":
+			methods.Password = true
+		case "cert":
+			methods.Certificate = true
+		case "":
+		default:
+			return AuthMethods{}, fmt.Errorf("invalid auth method %q (expected jwt, password or cert)", method)
+		}
+	}
+	if methods == (AuthMethods{}) {
+		return AuthMethods{}, fmt.Errorf("no auth methods in %q", value)
+	}
+	return methods, nil
+}
+
+// parseSocketMode parses octal socket permissions, defaulting to 0777
+func parseSocketMode(value string) (os.FileMode, error) {
+	if value == "" {
+		return 0o777, nil
+	}
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0o777 {
+		return 0, fmt.Errorf("invalid socket mode %q (expected octal permissions such as 0660)", value)
+	}
+	return os.FileMode(mode), nil
+}
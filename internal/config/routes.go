@@ -0,0 +1,108 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Route maps client database names to an upstream, optionally under a
+// different database name on that upstream
+type Route struct {
+	Pattern  string // Database name or glob pattern (path.Match syntax)
+	Upstream string // Upstream name
+	Database string // Database name on the upstream; empty keeps the client's name
+}
+
+// Route returns the upstream serving a client database and the database name
+// to use on it. Exact names win over glob patterns; among patterns the first
+// match in the routing table wins. Databases without a route go to the default
+// upstream unchanged.
+func (c *Config) Route(database string) (*Upstream, string) {
+	var match *Route
+	for i := range c.Routes {
+		route := &c.Routes[i]
+		if route.Pattern == database {
+			match = route
+			break
+		}
+		if match == nil && isGlob(route.Pattern) {
+			if ok, _ := path.Match(route.Pattern, database); ok {
+				match = route
+			}
+		}
+	}
+
+	if match == nil {
+		return c.Upstreams[DefaultUpstream], database
+	}
+	if match.Database != "" {
+		return c.Upstreams[match.Upstream], match.Database
+	}
+	return c.Upstreams[match.Upstream], database
+}
+
+// loadRoutes builds the routing table from DATABASE_ROUTES, a comma separated
+// list of pattern=upstream[/database] entries, followed by the databases listed
+// on each upstream definition
+func loadRoutes(upstreams map[string]*Upstream) ([]Route, error) {
+	var routes []Route
+
+	for _, entry := range strings.Split(os.Getenv("DATABASE_ROUTES"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid route %q (expected pattern=upstream[/database])", entry)
+		}
+		target := strings.SplitN(parts[1], "/", 2)
+		route := Route{
+			Pattern:  strings.TrimSpace(parts[0]),
+			Upstream: strings.ToLower(strings.TrimSpace(target[0])),
+		}
+		if len(target) == 2 {
+			route.Database = strings.TrimSpace(target[1])
+		}
+		routes = append(routes, route)
+	}
+
+	// Upstream definitions are visited in name order so pattern precedence
+	// does not depend on environment ordering
+	names := make([]string, 0, len(upstreams))
+	for name := range upstreams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, database := range upstreams[name].Databases {
+			routes = append(routes, Route{Pattern: database, Upstream: name})
+		}
+	}
+
+	exact := make(map[string]string)
+	for _, route := range routes {
+		if _, exists := upstreams[route.Upstream]; !exists {
+			return nil, fmt.Errorf("route %q refers to unknown upstream %q", route.Pattern, route.Upstream)
+		}
+		if _, err := path.Match(route.Pattern, ""); err != nil || route.Pattern == "" {
+			return nil, fmt.Errorf("invalid database pattern %q", route.Pattern)
+		}
+		if isGlob(route.Pattern) {
+			continue
+		}
+		if other, exists := exact[route.Pattern]; exists && other != route.Upstream {
+			return nil, fmt.Errorf("database %q is routed to both upstream %q and %q", route.Pattern, other, route.Upstream)
+		}
+		exact[route.Pattern] = route.Upstream
+	}
+	return routes, nil
+}
+
+func isGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[")
+}
@@ -0,0 +1,171 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// DefaultUpstream is the name of the upstream built from DB_HOST/DB_PORT and
+// used for every database without an explicit route
+const DefaultUpstream = "default"
+
+const defaultDBPort = "5432"
+
+// Upstream is a PostgreSQL server the proxy can route clients to
+type Upstream struct {
+	Name        string
+	Host        string
+	Port        string
+	SSLMode     string   // libpq sslmode for auth and pooled connections; empty means prefer
+	SSLRootCert string   // CA bundle used to verify the server; empty uses the system roots
+	SSLCert     string   // Client certificate presented to the server, if any
+	SSLKey      string   // Private key for SSLCert
+	Databases   []string // Database names or glob patterns routed to this upstream
+	Replicas    []string // host:port of read replicas serving read-only traffic
+}
+
+// Address returns the host:port to dial for this upstream
+func (u *Upstream) Address() string {
+	return net.JoinHostPort(u.Host, u.Port)
+}
+
+// loadUpstreams builds the upstream table from the DB_* variables and any
+// UPSTREAM_<NAME>=postgres://host:port?sslmode=...&databases=a,b variables
+func loadUpstreams() (map[string]*Upstream, error) {
+	dbHost := os.Getenv("DB_HOST")
+	if dbHost == "" {
+		dbHost = "localhost"
+	}
+	dbPort := os.Getenv("DB_PORT")
+	if dbPort == "" {
+		dbPort = defaultDBPort
+	}
+	sslMode := os.Getenv("DB_SSLMODE")
+	if err := validateSSLMode(sslMode); err != nil {
+		return nil, fmt.Errorf("DB_SSLMODE: %w", err)
+	}
+	sslCert := os.Getenv("DB_SSLCERT")
+	sslKey := os.Getenv("DB_SSLKEY")
+	if (sslCert == "") != (sslKey == "") {
+		return nil, fmt.Errorf("DB_SSLCERT and DB_SSLKEY must be set together")
+	}
+	replicas, err := parseReplicas(os.Getenv("DB_REPLICAS"))
+	if err != nil {
+		return nil, fmt.Errorf("DB_REPLICAS: %w", err)
+	}
+
+	upstreams := map[string]*Upstream{
+		DefaultUpstream: {
+			Name:        DefaultUpstream,
+			Host:        dbHost,
+			Port:        dbPort,
+			SSLMode:     sslMode,
+			SSLRootCert: os.Getenv("DB_SSLROOTCERT"),
+			SSLCert:     sslCert,
+			SSLKey:      sslKey,
+			Replicas:    replicas,
+		},
+	}
+
+	for _, env := range os.Environ() {
+		if !strings.HasPrefix(env, "UPSTREAM_") {
+			continue
+		}
+		parts := strings.SplitN(env, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		name := strings.ToLower(strings.TrimPrefix(parts[0], "UPSTREAM_"))
+		upstream, err := parseUpstream(name, parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", parts[0], err)
+		}
+		upstreams[name] = upstream
+	}
+
+	return upstreams, nil
+}
+
+// parseUpstream parses an upstream definition of the form
+// postgres://host[:port][?sslmode=mode][&sslrootcert=..][&sslcert=..&sslkey=..]
+// [&databases=db1,db2,pattern_*][&replicas=host1:port,host2]
+func parseUpstream(name, value string) (*Upstream, error) {
+	u, err := url.Parse(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream URL: %w", err)
+	}
+	if u.Scheme != "postgres" && u.Scheme != "postgresql" {
+		return nil, fmt.Errorf("unsupported scheme %q (expected postgres://)", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("upstream host is required")
+	}
+
+	query := u.Query()
+	upstream := &Upstream{
+		Name:        name,
+		Host:        u.Hostname(),
+		Port:        u.Port(),
+		SSLMode:     query.Get("sslmode"),
+		SSLRootCert: query.Get("sslrootcert"),
+		SSLCert:     query.Get("sslcert"),
+		SSLKey:      query.Get("sslkey"),
+	}
+	if upstream.Port == "" {
+		upstream.Port = defaultDBPort
+	}
+	if err := validateSSLMode(upstream.SSLMode); err != nil {
+		return nil, err
+	}
+	if (upstream.SSLCert == "") != (upstream.SSLKey == "") {
+		return nil, fmt.Errorf("sslcert and sslkey must be set together")
+	}
+
+	for _, database := range strings.Split(query.Get("databases"), ",") {
+		if database = strings.TrimSpace(database); database == "" {
+			continue
+		}
+		if _, err := path.Match(database, ""); err != nil {
+			return nil, fmt.Errorf("invalid database pattern %q: %w", database, err)
+		}
+		upstream.Databases = append(upstream.Databases, database)
+	}
+
+	upstream.Replicas, err = parseReplicas(query.Get("replicas"))
+	if err != nil {
+		return nil, err
+	}
+	return upstream, nil
+}
+
+// parseReplicas parses a comma separated list of replica host[:port] addresses
+func parseReplicas(value string) ([]string, error) {
+	var replicas []string
+	for _, replica := range strings.Split(value, ",") {
+		if replica = strings.TrimSpace(replica); replica == "" {
+			continue
+		}
+		host, port, err := net.SplitHostPort(replica)
+		if err != nil {
+			host, port = strings.Trim(replica, "[]"), defaultDBPort
+		}
+		if host == "" {
+			return nil, fmt.Errorf("invalid replica address %q", replica)
+		}
+		replicas = append(replicas, net.JoinHostPort(host, port))
+	}
+	return replicas, nil
+}
+
+func validateSSLMode(mode string) error {
+	switch mode {
+	case "", "disable", "allow", "prefer", "require", "verify-ca", "verify-full":
+		return nil
+	}
+	return fmt.Errorf("invalid sslmode %q", mode)
+}
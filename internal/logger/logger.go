@@ -1,9 +1,13 @@
 package logger
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"os"
+	"strings"
 
 	"github.com/joho/godotenv"
 )
@@ -16,81 +20,194 @@ const (
 	DEBUG LogLevel = iota
 	// INFO level for general informational messages
 	INFO
+	// WARN level for conditions worth an operator's attention
+	WARN
+	// ERROR level for failures
+	ERROR
 )
 
-var currentLevel = INFO
+var slogLevels = map[LogLevel]slog.Level{
+	DEBUG: slog.LevelDebug,
+	INFO:  slog.LevelInfo,
+	WARN:  slog.LevelWarn,
+	ERROR: slog.LevelError,
+}
+
+// Logger writes printf-style messages as structured records. Attributes added
+// with With, such as a connection ID, are attached to every record.
+type Logger struct {
+	slog *slog.Logger
+}
+
+var (
+	level = new(slog.LevelVar)
+	std   = &Logger{slog: slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))}
+)
 
 // SetLevel sets the current logging level
-func SetLevel(level LogLevel) {
-	currentLevel = level
+func SetLevel(l LogLevel) {
+	level.Set(slogLevels[l])
 }
 
 // SetDebug enables debug logging
 func SetDebug() {
-	currentLevel = DEBUG
-	log.Println("Debug logging enabled")
+	SetLevel(DEBUG)
+	std.Debug("debug logging enabled")
 }
 
-// SetProduction enables production logging (INFO only)
+// SetProduction enables production logging (INFO and above)
 func SetProduction() {
-	currentLevel = INFO
+	SetLevel(INFO)
 }
 
 // IsDebug returns true if debug logging is enabled
 func IsDebug() bool {
-	return currentLevel == DEBUG
+	return level.Level() <= slog.LevelDebug
+}
+
+// SetFormat switches the output between "text" (logfmt style key=value pairs)
+// and "json" (one object per line)
+func SetFormat(format string, w io.Writer) error {
+	options := &slog.HandlerOptions{Level: level}
+	switch strings.ToLower(format) {
+	case "", "text":
+		std.slog = slog.New(slog.NewTextHandler(w, options))
+	case "json":
+		std.slog = slog.New(slog.NewJSONHandler(w, options))
+	default:
+		return fmt.Errorf("invalid log format %q (expected text or json)", format)
+	}
+	// Route the standard library logger through the same handler so stray
+	// log.Printf calls come out in the same format
+	slog.SetDefault(std.slog)
+	return nil
+}
+
+// With returns a logger that attaches the given key-value pairs to every record
+func With(args ...any) *Logger {
+	return std.With(args...)
+}
+
+// With returns a logger that attaches the given key-value pairs to every
+// record in addition to the receiver's
+func (l *Logger) With(args ...any) *Logger {
+	return &Logger{slog: l.get().With(args...)}
+}
+
+// get returns the underlying logger. A nil Logger logs without attributes so
+// callers that have not been given one keep working.
+func (l *Logger) get() *slog.Logger {
+	if l == nil {
+		return std.slog
+	}
+	return l.slog
+}
+
+func (l *Logger) log(lvl slog.Level, msg string) {
+	logger := l.get()
+	if !logger.Enabled(context.Background(), lvl) {
+		return
+	}
+	logger.Log(context.Background(), lvl, msg)
 }
 
 // Debug logs a message at DEBUG level
-func Debug(format string, args ...interface{}) {
-	if currentLevel <= DEBUG {
-		log.Printf("[DEBUG] "+format, args...)
+func (l *Logger) Debug(format string, args ...interface{}) {
+	if IsDebug() {
+		l.log(slog.LevelDebug, fmt.Sprintf(format, args...))
 	}
 }
 
+// Info logs a message at INFO level
+func (l *Logger) Info(format string, args ...interface{}) {
+	l.log(slog.LevelInfo, fmt.Sprintf(format, args...))
+}
+
+// Warn logs a message at WARN level
+func (l *Logger) Warn(format string, args ...interface{}) {
+	l.log(slog.LevelWarn, fmt.Sprintf(format, args...))
+}
+
+// Warnf logs a warning message and returns it as an error type
+func (l *Logger) Warnf(format string, args ...interface{}) error {
+	err := fmt.Errorf(format, args...)
+	l.log(slog.LevelWarn, err.Error())
+	return err
+}
+
+// Error logs a message at ERROR level
+func (l *Logger) Error(format string, args ...interface{}) {
+	l.log(slog.LevelError, fmt.Sprintf(format, args...))
+}
+
+// Errorf logs an error message and returns it as an error type
+func (l *Logger) Errorf(format string, args ...interface{}) error {
+	err := fmt.Errorf(format, args...)
+	l.log(slog.LevelError, err.Error())
+	return err
+}
+
+// Fatal logs a message at ERROR level and exits
+func (l *Logger) Fatal(format string, args ...interface{}) {
+	l.get().Error(fmt.Sprintf(format, args...), "fatal", true)
+	os.Exit(1)
+}
+
+// Debug logs a message at DEBUG level
+func Debug(format string, args ...interface{}) {
+	std.Debug(format, args...)
+}
+
 // Info logs a message at INFO level
 func Info(format string, args ...interface{}) {
-	if currentLevel <= INFO {
-		log.Printf("[INFO] "+format, args...)
-	}
+	std.Info(format, args...)
 }
 
-// Error logs an error message (always shown)
+// Error logs an error message
 func Error(format string, args ...interface{}) {
-	log.Printf("[ERROR] "+format, args...)
+	std.Error(format, args...)
 }
 
 // Errorf logs an error message and returns it as an error type
 func Errorf(format string, args ...interface{}) error {
-	log.Printf("[ERROR] "+format, args...)
-	return fmt.Errorf(format, args...)
+	return std.Errorf(format, args...)
 }
 
-// Warn logs a warning message (always shown)
+// Warn logs a warning message
 func Warn(format string, args ...interface{}) {
-	log.Printf("[WARN] "+format, args...)
+	std.Warn(format, args...)
 }
 
 // Warnf logs a warning message and returns it as an error type
 func Warnf(format string, args ...interface{}) error {
-	log.Printf("[WARN] "+format, args...)
-	return fmt.Errorf(format, args...)
+	return std.Warnf(format, args...)
 }
 
 func Fatal(format string, args ...interface{}) {
-	log.Fatalf("[FATAL] "+format, args...)
+	std.Fatal(format, args...)
 }
 
-// InitFromEnv initializes logging based on environment variables
+// InitFromEnv initializes logging based on environment variables: LOG_LEVEL
+// (debug, info, warn or error; production is an alias for info) and
+// LOG_FORMAT (text or json)
 func InitFromEnv() {
 	err := godotenv.Load(".env") // filename of your env file
 	if err != nil {
 		log.Printf("Warning: could not load .env file, falling back to system environment")
 	}
-	logLevel := os.Getenv("LOG_LEVEL")
-	if logLevel == "debug" || logLevel == "DEBUG" {
+
+	if err := SetFormat(os.Getenv("LOG_FORMAT"), os.Stderr); err != nil {
+		log.Fatalf("invalid LOG_FORMAT: %v", err)
+	}
+
+	switch strings.ToLower(os.Getenv("LOG_LEVEL")) {
+	case "debug":
 		SetDebug()
-	} else {
+	case "warn", "warning":
+		SetLevel(WARN)
+	case "error":
+		SetLevel(ERROR)
+	default:
 		SetProduction()
 	}
 }
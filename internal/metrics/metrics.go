@@ -0,0 +1,186 @@
+// Package metrics defines the proxy's Prometheus metrics. They live in their
+// own registry, served by the admin listener, so nothing else in the process
+// can add to or collide with them.
+package metrics
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "gprxy"
+
+// Registry holds every gprxy metric plus the Go runtime and process collectors
+var Registry = prometheus.NewRegistry()
+
+var (
+	// ClientConnections counts client connections currently open, per listener
+	ClientConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "client_connections",
+		Help:      "Client connections currently open.",
+	}, []string{"listener"})
+
+	// ClientConnectionsAccepted counts client connections accepted, per listener
+	ClientConnectionsAccepted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "client_connections_accepted_total",
+		Help:      "Client connections accepted.",
+	}, []string{"listener"})
+
+	// StartupDuration measures the time from a client's StartupMessage to
+	// ReadyForQuery, or to the error that ended the startup
+	StartupDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "startup_duration_seconds",
+		Help:      "Time from StartupMessage to ReadyForQuery, including authentication and backend assignment.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 12),
+	}, []string{"result"})
+
+	// AuthDuration measures authentication against the upstream, by method
+	AuthDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "auth_duration_seconds",
+		Help:      "Time spent authenticating a client, by method (jwt, password, cert or unknown) and result.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 12),
+	}, []string{"method", "result"})
+
+	// JWTValidationFailures counts rejected access tokens by reason
+	JWTValidationFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "jwt_validation_failures_total",
+		Help:      "Access tokens rejected, by reason.",
+	}, []string{"reason"})
+
+	// QueryDuration measures statements from the request being sent to the
+	// backend until its CommandComplete, by command tag
+	QueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "query_duration_seconds",
+		Help:      "Statement round trip time through the proxy, by command tag.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 4, 10),
+	}, []string{"command"})
+
+	// ClientBytesReceived counts bytes read from clients, per listener
+	ClientBytesReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "client_received_bytes_total",
+		Help:      "Bytes received from clients, including TLS overhead.",
+	}, []string{"listener"})
+
+	// ClientBytesSent counts bytes written to clients, per listener
+	ClientBytesSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "client_sent_bytes_total",
+		Help:      "Bytes sent to clients, including TLS overhead.",
+	}, []string{"listener"})
+
+	// CopyBytes counts CopyData payload relayed during COPY, by direction: in
+	// from the client to the backend, out from the backend to the client
+	CopyBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "copy_bytes_total",
+		Help:      "CopyData payload bytes relayed during COPY, by direction (in or out).",
+	}, []string{"direction"})
+
+	// CopyMessages counts CopyData messages relayed during COPY, by direction
+	CopyMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "copy_messages_total",
+		Help:      "CopyData messages relayed during COPY, by direction (in or out).",
+	}, []string{"direction"})
+
+	// CancelRequests counts cancel requests by outcome
+	CancelRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cancel_requests_total",
+		Help:      "Cancel requests received, by result (forwarded, unknown, idle or failed).",
+	}, []string{"result"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		ClientConnections,
+		ClientConnectionsAccepted,
+		StartupDuration,
+		AuthDuration,
+		JWTValidationFailures,
+		QueryDuration,
+		ClientBytesReceived,
+		ClientBytesSent,
+		CopyBytes,
+		CopyMessages,
+		CancelRequests,
+	)
+}
+
+// Handler serves the registry in the Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// Since returns the seconds elapsed since start, for Observe calls
+func Since(start time.Time) float64 {
+	return time.Since(start).Seconds()
+}
+
+// Result labels an outcome as success or failure
+func Result(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+// CommandLabel reduces a command tag such as "INSERT 0 5" or "CREATE TABLE" to
+// its command words so row counts do not create new series
+func CommandLabel(tag string) string {
+	var words []string
+	for _, word := range strings.Fields(tag) {
+		if word[0] >= '0' && word[0] <= '9' {
+			break
+		}
+		words = append(words, word)
+	}
+	if len(words) == 0 {
+		return "UNKNOWN"
+	}
+	return strings.Join(words, " ")
+}
+
+// countingConn counts the bytes a client connection reads and writes
+type countingConn struct {
+	net.Conn
+	received prometheus.Counter
+	sent     prometheus.Counter
+}
+
+// CountBytes wraps a client connection so its traffic is added to the byte
+// counters of its listener
+func CountBytes(conn net.Conn, listener string) net.Conn {
+	return &countingConn{
+		Conn:     conn,
+		received: ClientBytesReceived.WithLabelValues(listener),
+		sent:     ClientBytesSent.WithLabelValues(listener),
+	}
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.received.Add(float64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.sent.Add(float64(n))
+	return n, err
+}
@@ -0,0 +1,46 @@
+package pool
+
+import (
+	"sync"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Backends whose application_name still carries the trace label of the last
+// client that used them. The label is only cleared when a client that would
+// not overwrite it is assigned the backend, which saves a round trip per
+// transaction when every client is traced.
+var (
+	labelledBackends = make(map[*pgconn.PgConn]struct{})
+	labelledMutex    sync.Mutex
+)
+
+// IsLabelled reports whether the backend's application_name was set by the
+// proxy and not reset since
+func IsLabelled(conn *pgxpool.Conn) bool {
+	labelledMutex.Lock()
+	defer labelledMutex.Unlock()
+
+	_, labelled := labelledBackends[conn.Conn().PgConn()]
+	return labelled
+}
+
+// SetLabelled records whether the backend's application_name carries a label
+func SetLabelled(conn *pgxpool.Conn, labelled bool) {
+	labelledMutex.Lock()
+	defer labelledMutex.Unlock()
+
+	if labelled {
+		labelledBackends[conn.Conn().PgConn()] = struct{}{}
+	} else {
+		delete(labelledBackends, conn.Conn().PgConn())
+	}
+}
+
+func forgetLabel(conn *pgconn.PgConn) {
+	labelledMutex.Lock()
+	defer labelledMutex.Unlock()
+
+	delete(labelledBackends, conn)
+}
@@ -2,7 +2,9 @@ package pool
 
 import (
 	"context"
+	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jackc/pgx/v5/pgxpool"
@@ -11,17 +13,39 @@ import (
 )
 
 type poolKey struct {
+	upstream string
+	replica  int // 0 for the primary, otherwise the 1-based replica index
 	user     string
 	database string
 }
 
+// String names the server a pool connects to in log messages
+func (k poolKey) String() string {
+	if k.replica == 0 {
+		return k.upstream + " primary"
+	}
+	return fmt.Sprintf("%s replica %d", k.upstream, k.replica)
+}
+
 var (
 	poolManager = make(map[poolKey]*pgxpool.Pool)
 	poolMutex   sync.RWMutex
+
+	// replicaCursor rotates replica selection across acquisitions
+	replicaCursor atomic.Uint32
 )
 
-// GetOrCreatePool returns an existing pool or creates a new one for the given database
-func GetOrCreatePool(user, database, connectionString string) (*pgxpool.Pool, error) {
+// GetOrCreatePool returns an existing pool or creates a new one for the given database on an upstream's primary.
+// Messages are logged through log, the logger of the client that needs the pool.
+func GetOrCreatePool(log *logger.Logger, upstream, user, database, connectionString string) (*pgxpool.Pool, error) {
+	return getOrCreatePool(log, poolKey{
+		upstream: upstream,
+		user:     user,
+		database: database,
+	}, connectionString)
+}
+
+func getOrCreatePool(log *logger.Logger, key poolKey, connectionString string) (*pgxpool.Pool, error) {
 	const defaultMaxConns = int32(5)
 	const defaultMinConns = int32(0)
 	const defaultMaxConnLifetime = time.Hour
@@ -29,10 +53,6 @@ func GetOrCreatePool(user, database, connectionString string) (*pgxpool.Pool, er
 	const defaultHealthCheckPeriod = time.Minute
 	const defaultConnectTimeout = time.Second * 5
 
-	key := poolKey{
-		user:     user,
-		database: database,
-	}
 	poolMutex.RLock()
 	pool, exists := poolManager[key]
 	poolMutex.RUnlock()
@@ -50,7 +70,7 @@ func GetOrCreatePool(user, database, connectionString string) (*pgxpool.Pool, er
 
 	config, err := pgxpool.ParseConfig(connectionString)
 	if err != nil {
-		return nil, logger.Errorf("failed to parse config: %w", err)
+		return nil, log.Errorf("failed to parse config: %w", err)
 	}
 
 	config.MaxConns = defaultMaxConns
@@ -59,32 +79,70 @@ func GetOrCreatePool(user, database, connectionString string) (*pgxpool.Pool, er
 	config.MaxConnIdleTime = defaultMaxConnIdleTime
 	config.HealthCheckPeriod = defaultHealthCheckPeriod
 	config.ConnConfig.ConnectTimeout = defaultConnectTimeout
+	config.BeforeClose = forgetConn
 
 	pool, err = pgxpool.NewWithConfig(context.Background(), config)
 	if err != nil {
-		return nil, logger.Errorf("failed to create pool: %w", err)
+		return nil, log.Errorf("failed to create pool: %w", err)
 	}
 	poolManager[key] = pool
-	logger.Info("created connection pool for database: %s", database)
+	log.Info("created connection pool for database: %s (upstream: %s)", key.database, key)
 	return pool, nil
 }
 
-// AcquireConnection acquires a connection from the pool for the given database and user
-func AcquireConnection(user, database, connectionString string) (*pgxpool.Conn, error) {
-	pool, err := GetOrCreatePool(user, database, connectionString)
+// AcquireConnection acquires a connection from the pool for the given upstream, database and user
+func AcquireConnection(log *logger.Logger, upstream, user, database, connectionString string) (*pgxpool.Conn, error) {
+	pool, err := GetOrCreatePool(log, upstream, user, database, connectionString)
 	if err != nil {
-		return nil, logger.Errorf("error while creating connection to the database: %w", err)
+		return nil, log.Errorf("error while creating connection to the database: %w", err)
 	}
 
+	return acquire(log, pool)
+}
+
+// AcquireReplicaConnection acquires a connection for the given upstream,
+// database and user from one of the upstream's replica pools. Replicas are
+// tried in rotation until one of them hands out a working connection.
+func AcquireReplicaConnection(log *logger.Logger, upstream, user, database string, connectionStrings []string) (*pgxpool.Conn, error) {
+	if len(connectionStrings) == 0 {
+		return nil, log.Errorf("no replicas configured for upstream %s", upstream)
+	}
+
+	start := int(replicaCursor.Add(1))
+	var lastErr error
+	for i := range connectionStrings {
+		index := (start + i) % len(connectionStrings)
+		key := poolKey{
+			upstream: upstream,
+			replica:  index + 1,
+			user:     user,
+			database: database,
+		}
+
+		pool, err := getOrCreatePool(log, key, connectionStrings[index])
+		if err == nil {
+			var connection *pgxpool.Conn
+			connection, err = acquire(log, pool)
+			if err == nil {
+				return connection, nil
+			}
+		}
+		log.Warn("%s unavailable for database %s: %v", key, database, err)
+		lastErr = err
+	}
+	return nil, log.Errorf("no replica available: %w", lastErr)
+}
+
+func acquire(log *logger.Logger, pool *pgxpool.Pool) (*pgxpool.Conn, error) {
 	connection, err := pool.Acquire(context.Background())
 	if err != nil {
-		return nil, logger.Errorf("error while acquiring connection from the database pool: %w", err)
+		return nil, log.Errorf("error while acquiring connection from the database pool: %w", err)
 	}
 
 	err = connection.Ping(context.Background())
 	if err != nil {
 		connection.Release()
-		return nil, logger.Errorf("could not ping database: %w", err)
+		return nil, log.Errorf("could not ping database: %w", err)
 	}
 
 	return connection, nil
@@ -0,0 +1,74 @@
+package pool
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gprxy/internal/metrics"
+)
+
+var poolLabels = []string{"upstream", "server", "user", "database"}
+
+// poolCollector reports pgxpool.Stat for every pool at scrape time, so the
+// numbers are never staler than the scrape itself
+type poolCollector struct {
+	total       *prometheus.Desc
+	acquired    *prometheus.Desc
+	idle        *prometheus.Desc
+	maxConns    *prometheus.Desc
+	acquires    *prometheus.Desc
+	emptyWaits  *prometheus.Desc
+	waitSeconds *prometheus.Desc
+}
+
+func newPoolCollector() *poolCollector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc("gprxy_pool_"+name, help, poolLabels, nil)
+	}
+	return &poolCollector{
+		total:       desc("total_connections", "Backend connections in the pool, including ones being established."),
+		acquired:    desc("acquired_connections", "Backend connections currently assigned to clients."),
+		idle:        desc("idle_connections", "Backend connections idle in the pool."),
+		maxConns:    desc("max_connections", "Maximum size of the pool."),
+		acquires:    desc("acquires_total", "Connections acquired from the pool."),
+		emptyWaits:  desc("empty_acquires_total", "Acquires that had to wait because the pool had no idle connection."),
+		waitSeconds: desc("acquire_wait_seconds_total", "Time spent waiting by acquires that found the pool empty."),
+	}
+}
+
+func (c *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.total
+	ch <- c.acquired
+	ch <- c.idle
+	ch <- c.maxConns
+	ch <- c.acquires
+	ch <- c.emptyWaits
+	ch <- c.waitSeconds
+}
+
+func (c *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	poolMutex.RLock()
+	defer poolMutex.RUnlock()
+
+	for key, pool := range poolManager {
+		server := "primary"
+		if key.replica > 0 {
+			server = fmt.Sprintf("replica%d", key.replica)
+		}
+		labels := []string{key.upstream, server, key.user, key.database}
+
+		stats := pool.Stat()
+		ch <- prometheus.MustNewConstMetric(c.total, prometheus.GaugeValue, float64(stats.TotalConns()), labels...)
+		ch <- prometheus.MustNewConstMetric(c.acquired, prometheus.GaugeValue, float64(stats.AcquiredConns()), labels...)
+		ch <- prometheus.MustNewConstMetric(c.idle, prometheus.GaugeValue, float64(stats.IdleConns()), labels...)
+		ch <- prometheus.MustNewConstMetric(c.maxConns, prometheus.GaugeValue, float64(stats.MaxConns()), labels...)
+		ch <- prometheus.MustNewConstMetric(c.acquires, prometheus.CounterValue, float64(stats.AcquireCount()), labels...)
+		ch <- prometheus.MustNewConstMetric(c.emptyWaits, prometheus.CounterValue, float64(stats.EmptyAcquireCount()), labels...)
+		ch <- prometheus.MustNewConstMetric(c.waitSeconds, prometheus.CounterValue, stats.EmptyAcquireWaitTime().Seconds(), labels...)
+	}
+}
+
+func init() {
+	metrics.Registry.MustRegister(newPoolCollector())
+}
@@ -0,0 +1,66 @@
+package pool
+
+import (
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Prepared statements created by the proxy on behalf of clients, keyed by the
+// physical backend connection they live on. Clients in transaction or statement
+// pooling mode move between backends, so the proxy needs to know which
+// statements a backend already holds before re-preparing them.
+var (
+	preparedStatements = make(map[*pgconn.PgConn]map[string]struct{})
+	preparedMutex      sync.Mutex
+)
+
+// IsPrepared reports whether the named statement exists on the backend
+func IsPrepared(conn *pgxpool.Conn, name string) bool {
+	preparedMutex.Lock()
+	defer preparedMutex.Unlock()
+
+	_, exists := preparedStatements[conn.Conn().PgConn()][name]
+	return exists
+}
+
+// MarkPrepared records that the named statement has been created on the backend
+func MarkPrepared(conn *pgxpool.Conn, name string) {
+	preparedMutex.Lock()
+	defer preparedMutex.Unlock()
+
+	pgConn := conn.Conn().PgConn()
+	statements, exists := preparedStatements[pgConn]
+	if !exists {
+		statements = make(map[string]struct{})
+		preparedStatements[pgConn] = statements
+	}
+	statements[name] = struct{}{}
+}
+
+// UnmarkPrepared forgets a single statement, e.g. after its Parse failed
+func UnmarkPrepared(conn *pgxpool.Conn, name string) {
+	preparedMutex.Lock()
+	defer preparedMutex.Unlock()
+
+	delete(preparedStatements[conn.Conn().PgConn()], name)
+}
+
+// ForgetPrepared forgets every statement on the backend. Call it after
+// anything that drops server-side statements, such as DISCARD ALL.
+func ForgetPrepared(conn *pgxpool.Conn) {
+	forgetConn(conn.Conn())
+}
+
+// forgetConn is installed as the pool's BeforeClose hook so closed backends do
+// not linger in the registries
+func forgetConn(conn *pgx.Conn) {
+	forgetLabel(conn.PgConn())
+
+	preparedMutex.Lock()
+	defer preparedMutex.Unlock()
+
+	delete(preparedStatements, conn.PgConn())
+}
@@ -4,22 +4,23 @@ import (
 	"gprxy/internal/logger"
 )
 
-// LogPoolStats logs statistics for the given database pool
-func LogPoolStats(user, database string) {
-	key := poolKey{
-		user:     user,
-		database: database,
-	}
+// LogPoolStats logs statistics for the given database's primary and replica pools
+func LogPoolStats(log *logger.Logger, upstream, user, database string) {
 	poolMutex.RLock()
-	pool, exists := poolManager[key]
-	poolMutex.RUnlock()
+	defer poolMutex.RUnlock()
 
-	if !exists {
-		logger.Warn("no pool found for user %s and database: %s", user, database)
-		return
+	found := false
+	for key, pool := range poolManager {
+		if key.upstream != upstream || key.user != user || key.database != database {
+			continue
+		}
+		found = true
+		stats := pool.Stat()
+		log.Debug("pool stats for [%s,%s] on %s - total: %d, acquired: %d, idle: %d", user, database, key,
+			stats.TotalConns(), stats.AcquiredConns(), stats.IdleConns())
 	}
 
-	stats := pool.Stat()
-	logger.Debug("pool stats for [%s,%s] - total: %d, acquired: %d, idle: %d", user, database,
-		stats.TotalConns(), stats.AcquiredConns(), stats.IdleConns())
+	if !found {
+		log.Warn("no pool found for user %s and database: %s", user, database)
+	}
 }
@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgproto3/v2"
+
+	"gprxy/internal/audit"
+)
+
+// auditPortal is what an audited Execute of a portal runs
+type auditPortal struct {
+	statement string
+	sql       string
+	params    int
+}
+
+// auditEntry collects the reply to an audited Query or Execute until it is
+// written out
+type auditEntry struct {
+	protocol  string
+	statement string
+	sql       string
+	params    int
+	tag       string
+	rows      int64
+	hasRows   bool
+	code      string
+}
+
+// trackStatement remembers the SQL behind the client's prepared statements and
+// portals, so an Execute can be audited with the statement it runs. The
+// caller must hold pc.mu.
+func (pc *Connection) trackStatement(msg pgproto3.FrontendMessage) {
+	if !pc.audit.Enabled() {
+		return
+	}
+	if pc.auditStatements == nil {
+		pc.auditStatements = make(map[string]string)
+		pc.auditPortals = make(map[string]auditPortal)
+	}
+
+	switch m := msg.(type) {
+	case *pgproto3.Parse:
+		pc.auditStatements[m.Name] = m.Query
+	case *pgproto3.Bind:
+		pc.auditPortals[m.DestinationPortal] = auditPortal{
+			statement: m.PreparedStatement,
+			sql:       pc.auditStatements[m.PreparedStatement],
+			params:    len(m.Parameters),
+		}
+	case *pgproto3.Close:
+		if m.ObjectType == 'S' {
+			delete(pc.auditStatements, m.Name)
+		} else {
+			delete(pc.auditPortals, m.Name)
+		}
+	}
+}
+
+// startAudit starts the audit entry for a Query or Execute forwarded to the
+// backend, or returns nil if auditing is off
+func (pc *Connection) startAudit(msg pgproto3.FrontendMessage) *auditEntry {
+	if !pc.audit.Enabled() {
+		return nil
+	}
+	switch m := msg.(type) {
+	case *pgproto3.Query:
+		return &auditEntry{protocol: "simple", sql: m.String}
+	case *pgproto3.Execute:
+		portal := pc.auditPortals[m.Portal]
+		return &auditEntry{protocol: "extended", statement: portal.statement, sql: portal.sql, params: portal.params}
+	}
+	return nil
+}
+
+// auditReply records a backend message on the audit entry of the reply at the
+// head of the queue. A simple query holding several statements keeps the last
+// command tag and the total of the row counts.
+func (pc *Connection) auditReply(msg pgproto3.BackendMessage) {
+	if len(pc.replies) == 0 || pc.replies[0].audit == nil {
+		return
+	}
+	entry := pc.replies[0].audit
+	switch msg := msg.(type) {
+	case *pgproto3.CommandComplete:
+		entry.tag = string(msg.CommandTag)
+		if rows, ok := rowsAffected(entry.tag); ok {
+			entry.rows += rows
+			entry.hasRows = true
+		}
+	case *pgproto3.ErrorResponse:
+		entry.code = msg.Code
+	}
+}
+
+// redactSQL masks literal values in statement text under the audit log's
+// redaction setting, for anything that records what clients ran
+func (pc *Connection) redactSQL(sql string) string {
+	switch pc.audit.Redaction() {
+	case audit.RedactStrings:
+		return redactLiterals(sql, false)
+	case audit.RedactLiterals:
+		return redactLiterals(sql, true)
+	}
+	return sql
+}
+
+// finishAudit writes the audit record of a reply leaving the queue, if it has
+// one. code is the error that ended the request when the backend skipped it;
+// incomplete marks requests whose reply never arrived.
+func (pc *Connection) finishAudit(reply *pendingReply, code string, incomplete bool) {
+	entry := reply.audit
+	if entry == nil {
+		return
+	}
+	if entry.code == "" {
+		entry.code = code
+	}
+
+	sql := pc.redactSQL(entry.sql)
+
+	record := &audit.Record{
+		Time:       reply.sent.UTC(),
+		ConnID:     pc.id,
+		Database:   pc.db,
+		Client:     pc.conn.RemoteAddr().String(),
+		Listener:   pc.listener.Name,
+		Route:      pc.route,
+		Protocol:   entry.protocol,
+		Statement:  entry.statement,
+		SQL:        sql,
+		Params:     entry.params,
+		CommandTag: entry.tag,
+		DurationMS: float64(time.Since(reply.sent).Microseconds()) / 1000,
+		ErrorCode:  entry.code,
+		Incomplete: incomplete,
+	}
+	if pc.identity != nil {
+		record.Email = pc.identity.Email
+		record.Subject = pc.identity.Subject
+		record.AuthMethod = pc.identity.Method
+		record.ServiceAccount = pc.identity.ServiceAccount
+	}
+	if entry.hasRows {
+		record.Rows = &entry.rows
+	}
+	pc.audit.Write(record)
+	reply.audit = nil
+}
+
+// rowsAffected returns the row count at the end of a command tag such as
+// "INSERT 0 5" or "UPDATE 3". Tags without one, like "CREATE TABLE", report
+// false.
+func rowsAffected(tag string) (int64, bool) {
+	fields := strings.Fields(tag)
+	if len(fields) < 2 {
+		return 0, false
+	}
+	rows, err := strconv.ParseInt(fields[len(fields)-1], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return rows, true
+}
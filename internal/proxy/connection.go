@@ -2,92 +2,442 @@ package proxy
 
 import (
 	"context"
+	"crypto/rand"
 	"crypto/tls"
 	"encoding/binary"
-	"fmt"
 	"net"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/jackc/pgproto3/v2"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
+	"gprxy/internal/audit"
+	"gprxy/internal/auth"
 	"gprxy/internal/config"
 	"gprxy/internal/logger"
+	"gprxy/internal/metrics"
 	"gprxy/internal/pool"
+	"gprxy/internal/tracing"
 )
 
 // Connection represents a single client-proxy connection
 type Connection struct {
 	conn      net.Conn
+	id        string // Random connection ID, logged as conn_id
 	config    *config.Config
+	listener  *config.Listener // Listener the client connected through
+	log       *logger.Logger   // Logger tagged with the connection ID
+	ctx       context.Context  // Carries the connection's root span
 	poolConn  *pgxpool.Conn
 	bf        *pgproto3.Frontend
 	user      string
-	db        string
+	db        string // Database name on the upstream, after any routing rewrite
+	appName   string // application_name from the client's startup message
+	upstream  *config.Upstream
+	readOnly  bool   // Client asked for a read-only session, see readOnlySession
+	route     string // Server the current backend belongs to, for query logs
+	onReplica bool   // The current backend came from a replica pool
 	tlsConfig *tls.Config
 	server    *Server
 	key       *pgproto3.BackendKeyData
+	identity  *auth.Identity // Who the client authenticated as
+	audit     *audit.Log     // Audit sink, nil when auditing is off
+
+	// backendMu guards poolConn against concurrent reads from cancel requests
+	// while a transaction-pooled client swaps backends
+	backendMu sync.Mutex
+
+	// mu serialises the client and backend pumps. It guards the protocol
+	// state below, backend assignment and writes to the client.
+	mu        sync.Mutex
+	client    *pgproto3.Backend          // Client-side protocol handle once startup completes
+	outbound  []pgproto3.FrontendMessage // Messages routed to the backend, written after mu is released
+	pumpDone  chan struct{}              // Closed when the current backend pump exits
+	closing   bool                       // Set once the connection is shutting down
+	closeOnce sync.Once
+
+	txStatus      byte                // Transaction status from the last ReadyForQuery
+	replies       []pendingReply      // Requests awaiting a reply, in wire order
+	cycleFailed   bool                // An error was reported since the last ReadyForQuery
+	skipUntilSync bool                // Discard extended-protocol messages until Sync after a rejection
+	failedToSync  bool                // The backend reported an error and skips messages until the next Sync
+	pendingSets   []string            // SET/RESET statements awaiting the end of their transaction
+	statementSets map[string][]string // SET/RESET statements in parsed statements, by statement name
+	portalSets    map[string][]string // SET/RESET statements in bound portals, by portal name
+	rolledBack    bool                // A ROLLBACK completed since the last ReadyForQuery
+	sessionSets   []string            // SET/RESET statements replayed on every newly assigned backend
+	copy          *copyState          // COPY exchange in progress, if any
+
+	// statements maps the client's prepared statement names to their
+	// definitions so they can be re-prepared on any backend
+	statements map[string]*preparedStatement
+
+	// auditStatements and auditPortals hold the SQL behind the client's
+	// statements and portals while auditing
+	auditStatements map[string]string
+	auditPortals    map[string]auditPortal
 }
 
 // handleConnection processes a single client connection in its own goroutine
 func (pc *Connection) handleConnection() {
-	logger.Debug("new client connection established")
-	pgc := pgproto3.NewBackend(pgproto3.NewChunkReader(pc.conn), pc.conn)
+	pc.log.Debug("new client connection established")
+	ctx, span := tracing.Tracer().Start(context.Background(), "gprxy.connection",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("gprxy.listener", pc.listener.Name),
+			attribute.String("client.address", pc.conn.RemoteAddr().String()),
+		))
+	pc.ctx = ctx
+	defer span.End()
+
+	active := metrics.ClientConnections.WithLabelValues(pc.listener.Name)
+	active.Inc()
+	defer active.Dec()
 
 	defer func() {
-		if err := pc.conn.Close(); err != nil {
-			logger.Error("error closing client connection: %v", err)
+		pc.closeClient()
+		pc.stopBackendPump()
+		for i := range pc.replies {
+			endReplySpan(&pc.replies[i])
+			pc.finishAudit(&pc.replies[i], "", true)
 		}
 
 		if pc.poolConn != nil {
-			err := fullResetBeforeRelease(pc)
-			if err != nil {
-				logger.Error("error while releasing connection back to the pool: %v", err)
+			if len(pc.replies) > 0 {
+				// The backend is mid-reply, so its protocol state is unknown
+				pc.log.Debug("client left with %d requests in flight, discarding backend", len(pc.replies))
+				pc.discardBackend()
+			} else if err := fullResetBeforeRelease(pc); err != nil {
+				pc.log.Error("error while releasing connection back to the pool: %v", err)
+				pc.discardBackend()
+			} else {
+				pc.setBackend(nil)
+				pc.log.Debug("released connection back to pool")
 			}
-			pc.poolConn.Release()
-			logger.Debug("released connection back to pool")
 		}
 		if pc.key != nil && pc.server != nil {
 			pc.server.unregisterConnection(pc.key.ProcessID, pc.key.SecretKey, pc)
 		}
-		logger.Info("connection closed")
+		pc.log.Info("connection closed")
 	}()
 
-	pgc, err := pc.handleStartupMessage(pgc)
+	err := pc.negotiateDirectTLS()
+	if err != nil {
+		pc.log.Error("startup failed: %v", err)
+		return
+	}
+
+	pgc := pgproto3.NewBackend(pgproto3.NewChunkReader(pc.conn), pc.conn)
+	pgc, err = pc.handleStartupMessage(pgc)
 	if err != nil {
-		logger.Error("startup failed: %v", err)
+		pc.log.Error("startup failed: %v", err)
 		return
 	}
 
-	logger.Debug("entering query handling loop")
+	pc.mu.Lock()
+	pc.client = pgc
+	if pc.poolConn != nil {
+		pc.startBackendPump()
+	}
+	pc.closeIfDraining()
+	pc.mu.Unlock()
+
+	pc.log.Debug("entering query handling loop")
 	for {
 		err := pc.handleMessage(pgc)
 		if err != nil {
-			logger.Debug("query handling terminated: %v", err)
+			pc.log.Debug("query handling terminated: %v", err)
 			return
 		}
 	}
 }
 
-// connectBackend establishes a connection to the backend database using connection pooling
-func (pc *Connection) connectBackend(database, user string) error {
-	connectionString := pc.config.BuildConnectionString(database)
+// startBackendPump starts the backend-to-client half of the relay for the
+// currently assigned backend. The caller must hold pc.mu.
+func (pc *Connection) startBackendPump() {
+	done := make(chan struct{})
+	pc.pumpDone = done
+	go pc.pumpBackend(pc.client, pc.bf, done)
+}
+
+// pumpBackend relays everything the backend sends to the client, including
+// replies to pipelined requests and notifications that arrive while the client
+// is idle, until the backend is released or the connection fails
+func (pc *Connection) pumpBackend(client *pgproto3.Backend, bf *pgproto3.Frontend, done chan struct{}) {
+	defer close(done)
+
+	for {
+		msg, err := bf.Receive()
+		if err != nil {
+			pc.mu.Lock()
+			closing := pc.closing
+			pc.mu.Unlock()
+			if !closing {
+				pc.log.Error("backend receive error: %v", err)
+				pc.closeClient()
+			}
+			return
+		}
+
+		pc.mu.Lock()
+		released, err := pc.relayMessage(client, msg)
+		pc.mu.Unlock()
+		if err != nil {
+			pc.log.Debug("backend relay terminated: %v", err)
+			pc.closeClient()
+			return
+		}
+		if released != nil {
+			// The reset runs without pc.mu so the client pump can carry on
+			// on its next backend meanwhile
+			released.finish(pc.log)
+			return
+		}
+	}
+}
+
+// stopBackendPump interrupts the backend pump's pending read and waits for it
+// to exit so the backend can be reset or discarded safely
+func (pc *Connection) stopBackendPump() {
+	pc.mu.Lock()
+	pc.closing = true
+	done := pc.pumpDone
+	if done != nil && pc.poolConn != nil {
+		pc.poolConn.Conn().PgConn().Conn().SetReadDeadline(time.Now())
+	}
+	pc.mu.Unlock()
+
+	if done == nil {
+		return
+	}
+	<-done
+	if pc.poolConn != nil {
+		pc.poolConn.Conn().PgConn().Conn().SetReadDeadline(time.Time{})
+	}
+}
+
+// closeIfDraining terminates the session with an admin_shutdown error, as
+// PostgreSQL does on a fast shutdown, if the proxy is draining and the client
+// is between transactions. Otherwise draining would wait for clients that may
+// never disconnect on their own. The caller must hold pc.mu.
+func (pc *Connection) closeIfDraining() {
+	if pc.server == nil || !pc.server.draining.Load() || pc.client == nil {
+		return
+	}
+	if pc.txStatus != 'I' || len(pc.replies) > 0 || pc.copy != nil {
+		return
+	}
+
+	pc.log.Info("closing idle session, proxy is shutting down")
+	pc.client.Send(&pgproto3.ErrorResponse{
+		Severity: "FATAL",
+		Code:     adminShutdown,
+		Message:  "terminating connection due to administrator command",
+	})
+	pc.closeClient()
+}
+
+// closeClient closes the client connection, unblocking the client pump
+func (pc *Connection) closeClient() {
+	pc.closeOnce.Do(func() {
+		if err := pc.conn.Close(); err != nil {
+			pc.log.Error("error closing client connection: %v", err)
+		}
+	})
+}
 
-	connection, err := pool.AcquireConnection(user, database, connectionString)
+// connectBackend establishes a connection to the backend database using
+// connection pooling. Replica backends are used when asked for and available,
+// falling back to the primary if no replica can be reached.
+func (pc *Connection) connectBackend(database, user string, replica bool) (err error) {
+	_, span := tracing.Tracer().Start(pc.ctx, "pool.acquire", trace.WithAttributes(
+		attribute.String("gprxy.upstream", pc.upstream.Name),
+		attribute.String("db.name", database),
+		attribute.String("db.user", user),
+		attribute.Bool("gprxy.replica_requested", replica),
+	))
+	defer func() {
+		span.SetAttributes(attribute.String("gprxy.route", pc.route))
+		tracing.End(span, err)
+	}()
+
+	if replica && len(pc.upstream.Replicas) > 0 {
+		connectionStrings := pc.config.BuildReplicaConnectionStrings(pc.upstream, database)
+		connection, err := pool.AcquireReplicaConnection(pc.log, pc.upstream.Name, user, database, connectionStrings)
+		if err == nil {
+			pc.setBackend(connection)
+			pc.route = "replica " + connection.Conn().PgConn().Conn().RemoteAddr().String()
+			pc.onReplica = true
+			pc.log.Debug("acquired replica connection from pool for database: %s", database)
+			pool.LogPoolStats(pc.log, pc.upstream.Name, user, database)
+			return nil
+		}
+		pc.log.Warn("falling back to primary for database %s: %v", database, err)
+	}
+
+	connectionString := pc.config.BuildConnectionString(pc.upstream, database)
+
+	connection, err := pool.AcquireConnection(pc.log, pc.upstream.Name, user, database, connectionString)
 	if err != nil {
 		return err
 	}
 
-	pc.poolConn = connection
-	logger.Debug("acquired connection from pool for database: %s", database)
+	pc.setBackend(connection)
+	pc.route = "primary"
+	pc.log.Debug("acquired connection from pool for database: %s", database)
+
+	pool.LogPoolStats(pc.log, pc.upstream.Name, user, database)
+
+	return nil
+}
+
+// acquireBackend checks out a pooled backend for the client's next transaction,
+// replays any session settings the client has made so far, labels it with the
+// trace context and starts relaying its replies. The caller must hold pc.mu.
+func (pc *Connection) acquireBackend(replica bool) error {
+	start := time.Now()
+	err := pc.connectBackend(pc.db, pc.user, replica)
+	if err != nil {
+		return err
+	}
 
-	pool.LogPoolStats(user, database)
+	var statements []string
+	label := pc.traceSetting()
+	if label == "" && pool.IsLabelled(pc.poolConn) {
+		// The previous client's trace label would otherwise stick
+		statements = append(statements, traceResetQuery)
+	}
+	statements = append(statements, pc.sessionSets...)
+	if label != "" {
+		statements = append(statements, label)
+	}
+	if len(statements) > 0 {
+		_, err = pc.poolConn.Exec(context.Background(), strings.Join(statements, "; "))
+		if err != nil {
+			pc.discardBackend()
+			return pc.log.Errorf("failed to replay session settings: %w", err)
+		}
+		pool.SetLabelled(pc.poolConn, label != "")
+		pc.log.Debug("[%s] replayed %d session settings on backend", pc.user, len(pc.sessionSets))
+	}
 
+	pc.log.Debug("[%s] backend assigned in %v (PID=%d)", pc.user, time.Since(start), pc.poolConn.Conn().PgConn().PID())
+	pc.startBackendPump()
 	return nil
 }
 
-func cancelRequest(host string, cancel *pgproto3.CancelRequest) error {
-	backendAddr := fmt.Sprintf("%s:5432", host)
+// releasedBackend is a backend detached from its client whose session
+// settings still have to be undone before it goes back to the pool
+type releasedBackend struct {
+	conn  *pgxpool.Conn
+	reset string // Statement undoing the client's session settings, if any
+}
+
+// releaseBackend detaches the client's backend once its transaction has
+// finished. It is called from the backend pump, which stops reading from the
+// backend afterwards and returns it to the pool with finish once pc.mu is
+// released. A trace label is left in place for the next client to overwrite
+// or reset, sparing a round trip per transaction.
+func (pc *Connection) releaseBackend() *releasedBackend {
+	released := &releasedBackend{conn: pc.detachBackend()}
+	if len(pc.sessionSets) > 0 {
+		released.reset = sessionResetQuery
+	}
+	return released
+}
+
+// finish undoes the session settings and releases the backend to the pool,
+// closing it instead if the reset fails
+func (r *releasedBackend) finish(log *logger.Logger) {
+	pid := r.conn.Conn().PgConn().PID()
+	if r.reset != "" {
+		_, err := r.conn.Exec(context.Background(), r.reset)
+		if err != nil {
+			log.Error("failed to reset session settings, discarding backend: %v", err)
+			r.conn.Conn().Close(context.Background())
+			r.conn.Release()
+			return
+		}
+		pool.SetLabelled(r.conn, false)
+	}
+	r.conn.Release()
+	log.Debug("backend released to pool (PID=%d)", pid)
+}
+
+// discardBackend closes the client's backend so the pool will not reuse it
+func (pc *Connection) discardBackend() {
+	pc.poolConn.Conn().Close(context.Background())
+	pc.setBackend(nil)
+}
+
+// detachBackend unbinds the client's backend without releasing it and returns
+// it
+func (pc *Connection) detachBackend() *pgxpool.Conn {
+	pc.backendMu.Lock()
+	defer pc.backendMu.Unlock()
+
+	conn := pc.poolConn
+	pc.poolConn = nil
+	pc.bf = nil
+	pc.route = ""
+	pc.onReplica = false
+	return conn
+}
+
+// setBackend swaps the client's pooled backend, releasing the previous one, and
+// rebinds the wire-level frontend used to relay messages to it
+func (pc *Connection) setBackend(conn *pgxpool.Conn) {
+	pc.backendMu.Lock()
+	defer pc.backendMu.Unlock()
+
+	if pc.poolConn != nil {
+		pc.poolConn.Release()
+	}
+	pc.poolConn = conn
+	pc.bf = nil
+	pc.route = ""
+	pc.onReplica = false
+	if conn != nil {
+		underlyingConn := conn.Conn().PgConn().Conn()
+		pc.bf = pgproto3.NewFrontend(pgproto3.NewChunkReader(underlyingConn), underlyingConn)
+	}
+}
+
+// backendKey returns the cancel key and server address of the backend
+// currently serving the client, if any
+func (pc *Connection) backendKey() (*pgproto3.CancelRequest, string, bool) {
+	pc.backendMu.Lock()
+	defer pc.backendMu.Unlock()
+
+	if pc.poolConn == nil {
+		return nil, "", false
+	}
+	pgConn := pc.poolConn.Conn().PgConn()
+	return &pgproto3.CancelRequest{
+		ProcessID: pgConn.PID(),
+		SecretKey: pgConn.SecretKey(),
+	}, pgConn.Conn().RemoteAddr().String(), true
+}
+
+// newProxyKey generates BackendKeyData for a client that is not pinned to a
+// single backend. Cancel requests carrying it are resolved through the server
+// registry and forwarded to whichever backend the client holds at the time.
+func newProxyKey() (*pgproto3.BackendKeyData, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, logger.Errorf("failed to generate backend key: %w", err)
+	}
+	return &pgproto3.BackendKeyData{
+		ProcessID: binary.BigEndian.Uint32(buf[0:4]),
+		SecretKey: binary.BigEndian.Uint32(buf[4:8]),
+	}, nil
+}
+
+func cancelRequest(backendAddr string, cancel *pgproto3.CancelRequest) error {
 	conn, err := net.DialTimeout("tcp", backendAddr, 5*time.Second)
 	if err != nil {
 		return logger.Errorf("failed to connect to backend: %w", err)
@@ -123,12 +473,14 @@ func cancelRequest(host string, cancel *pgproto3.CancelRequest) error {
 func fullResetBeforeRelease(connection *Connection) error {
 	_, err := connection.poolConn.Exec(context.Background(), "ROLLBACK")
 	if err != nil {
-		logger.Debug("unable to rollback: %v", err)
+		connection.log.Debug("unable to rollback: %v", err)
 		return err
 	}
 	_, err = connection.poolConn.Exec(context.Background(), "DISCARD ALL")
+	pool.ForgetPrepared(connection.poolConn)
+	pool.SetLabelled(connection.poolConn, false)
 	if err != nil {
-		logger.Debug("unable to execute discard all: %v", err)
+		connection.log.Debug("unable to execute discard all: %v", err)
 		return err
 	}
 	return nil
@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"time"
+
+	"github.com/jackc/pgproto3/v2"
+
+	"gprxy/internal/metrics"
+)
+
+// copyState tracks a COPY sub-protocol exchange from the backend's
+// CopyInResponse, CopyOutResponse or CopyBothResponse, or from the first copy
+// data the client pipelined ahead of it, until the CommandComplete or
+// ErrorResponse that ends it
+type copyState struct {
+	direction   string // "in", "out" or "both"; empty until the backend responds
+	started     time.Time
+	bytesIn     int64 // CopyData payload sent by the client
+	bytesOut    int64 // CopyData payload sent by the backend
+	messagesIn  int
+	messagesOut int
+}
+
+// startCopy records that the backend has entered copy mode. Copy data the
+// client pipelined ahead of the backend's response has already been counted.
+// The caller must hold pc.mu.
+func (pc *Connection) startCopy(direction string) {
+	if pc.copy == nil {
+		pc.copy = &copyState{started: time.Now()}
+	}
+	pc.copy.direction = direction
+	pc.log.Debug("[%s] COPY %s started", pc.user, direction)
+}
+
+// acceptCopyMessage counts a CopyData, CopyDone or CopyFail from the client and
+// reports whether it should be forwarded. Clients such as pgx send the copy
+// data right behind the COPY query without waiting for CopyInResponse, so the
+// decision follows wire order: copy messages go to the backend while a query
+// it has not answered yet is outstanding there. With nothing outstanding they
+// can only be strays, and in pooled modes forwarding them could reach a backend
+// the client no longer holds. The caller must hold pc.mu.
+func (pc *Connection) acceptCopyMessage(msg pgproto3.FrontendMessage) bool {
+	if pc.poolConn == nil || !pc.queryOutstanding() {
+		pc.log.Debug("[%s] dropping %T with no query outstanding", pc.user, msg)
+		return false
+	}
+
+	if pc.copy == nil {
+		pc.copy = &copyState{started: time.Now()}
+	}
+	switch m := msg.(type) {
+	case *pgproto3.CopyData:
+		pc.copy.bytesIn += int64(len(m.Data))
+		pc.copy.messagesIn++
+	case *pgproto3.CopyFail:
+		pc.log.Warn("[%s] client aborted COPY: %s", pc.user, m.Message)
+	}
+	return true
+}
+
+// queryOutstanding reports whether a forwarded Query or Execute is still
+// waiting for its reply from the backend
+func (pc *Connection) queryOutstanding() bool {
+	for i := range pc.replies {
+		reply := &pc.replies[i]
+		if reply.kind == replyForward && (reply.request == 'Q' || reply.request == 'E') {
+			return true
+		}
+	}
+	return false
+}
+
+// countCopyOut counts CopyData relayed from the backend. The caller must hold
+// pc.mu.
+func (pc *Connection) countCopyOut(data *pgproto3.CopyData) {
+	if pc.copy == nil {
+		return
+	}
+	pc.copy.bytesOut += int64(len(data.Data))
+	pc.copy.messagesOut++
+}
+
+// finishCopy logs the byte counters of a COPY once the backend has ended it and
+// adds them to the COPY metrics. The caller must hold pc.mu.
+func (pc *Connection) finishCopy(succeeded bool) {
+	if pc.copy == nil {
+		return
+	}
+	if pc.copy.direction == "" {
+		// The client sent copy data but the statement never entered copy
+		// mode; the backend ignored the data
+		pc.copy = nil
+		return
+	}
+
+	outcome := "completed"
+	if !succeeded {
+		outcome = "failed"
+	}
+	c := pc.copy
+	metrics.CopyBytes.WithLabelValues("in").Add(float64(c.bytesIn))
+	metrics.CopyBytes.WithLabelValues("out").Add(float64(c.bytesOut))
+	metrics.CopyMessages.WithLabelValues("in").Add(float64(c.messagesIn))
+	metrics.CopyMessages.WithLabelValues("out").Add(float64(c.messagesOut))
+	pc.log.Info("[%s] COPY %s %s: %d bytes in (%d messages), %d bytes out (%d messages) in %v",
+		pc.user, c.direction, outcome, c.bytesIn, c.messagesIn, c.bytesOut, c.messagesOut, time.Since(c.started))
+	pc.copy = nil
+}
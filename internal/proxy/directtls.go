@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+
+	"gprxy/internal/config"
+)
+
+// tlsHandshakeRecord is the first byte of a TLS ClientHello. A startup packet
+// begins with its length, whose high byte is always zero, so the two cannot be
+// confused.
+const tlsHandshakeRecord = 0x16
+
+// alpnPostgreSQL is the ALPN protocol PostgreSQL 17 clients require for
+// sslnegotiation=direct
+const alpnPostgreSQL = "postgresql"
+
+// peekedConn is a connection whose first bytes have been read ahead into a
+// buffer. Reads drain the buffer before touching the socket.
+type peekedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// negotiateDirectTLS sniffs the first byte a client sends. A TLS ClientHello
+// means the client uses direct TLS negotiation (sslnegotiation=direct) instead
+// of an SSLRequest, so the handshake is performed right away and the startup
+// continues over the encrypted connection. Anything else leaves the connection
+// untouched for the regular startup flow.
+func (pc *Connection) negotiateDirectTLS() error {
+	reader := bufio.NewReader(pc.conn)
+	first, err := reader.Peek(1)
+	if err != nil {
+		return pc.log.Errorf("failed to read from client: %w", err)
+	}
+	conn := &peekedConn{Conn: pc.conn, reader: reader}
+	if first[0] != tlsHandshakeRecord {
+		pc.conn = conn
+		return nil
+	}
+
+	if pc.tlsConfig == nil || pc.listener.TLSMode == config.TLSModeDisable {
+		return pc.log.Errorf("client attempted direct TLS but TLS is not enabled")
+	}
+
+	pc.log.Debug("direct TLS negotiation requested")
+	tlsConn, err := pc.handshakeTLS(conn, true)
+	if err != nil {
+		return pc.log.Errorf("direct TLS handshake failed: %w", err)
+	}
+
+	// Without ALPN a client speaking another protocol could be tricked into
+	// talking to the proxy, so PostgreSQL insists on it for direct TLS
+	if tlsConn.ConnectionState().NegotiatedProtocol != alpnPostgreSQL {
+		tlsConn.Close()
+		return pc.log.Errorf("direct TLS connection did not negotiate ALPN %q", alpnPostgreSQL)
+	}
+
+	pc.log.Debug("direct TLS handshake completed successfully")
+	pc.conn = tlsConn
+	return nil
+}
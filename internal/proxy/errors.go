@@ -1,21 +1,58 @@
 package proxy
 
 import (
-	"gprxy/internal/logger"
-
 	"github.com/jackc/pgproto3/v2"
 )
 
+// invalidAuthorization is the SQLSTATE reported when the proxy refuses a
+// client before authentication
+const invalidAuthorization = "28000"
+
 // sendErrorToClient sends an error message to the client
 func (pc *Connection) sendErrorToClient(cb *pgproto3.Backend, msg string) error {
+	return pc.sendFatalToClient(cb, "08006", msg)
+}
+
+// sendFatalToClient sends a FATAL ErrorResponse with the given SQLSTATE
+func (pc *Connection) sendFatalToClient(cb *pgproto3.Backend, code, msg string) error {
 	errMsg := &pgproto3.ErrorResponse{
 		Severity: "FATAL",
-		Code:     "08006",
+		Code:     code,
 		Message:  msg,
 	}
 	err := cb.Send(errMsg)
 	if err != nil {
-		return logger.Errorf("failed to send error to client: %w", err)
+		return pc.log.Errorf("failed to send error to client: %w", err)
+	}
+	return pc.log.Errorf("%s", msg)
+}
+
+// adminShutdown is the SQLSTATE PostgreSQL reports to sessions it terminates
+// while shutting down
+const adminShutdown = "57P01"
+
+// featureNotSupported is the SQLSTATE reported when the proxy refuses a request
+// its pooling mode cannot serve
+const featureNotSupported = "0A000"
+
+// rejectMessage reports a non-fatal error for a client request the proxy will
+// not forward. For a simple query the request cycle ends with ReadyForQuery;
+// for the extended protocol the remaining messages are discarded until the
+// next Sync. The error takes the rejected request's place in the reply stream.
+func (pc *Connection) rejectMessage(msg pgproto3.FrontendMessage, code, text string) error {
+	pc.log.Warn("[%s] rejected %T: %s", pc.user, msg, text)
+	request, _ := requestType(msg)
+	pc.synthesizeReply(request, &pgproto3.ErrorResponse{
+		Severity: "ERROR",
+		Code:     code,
+		Message:  text,
+	})
+	pc.cycleFailed = true
+
+	if _, ok := msg.(*pgproto3.Query); ok {
+		pc.synthesizeReply('Q', &pgproto3.ReadyForQuery{TxStatus: pc.txStatus})
+	} else {
+		pc.skipUntilSync = true
 	}
-	return logger.Errorf("%s", msg)
+	return nil
 }
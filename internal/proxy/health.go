@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// CheckListening is the liveness check: the listeners are open, or the proxy
+// is draining after closing them on purpose
+func (s *Server) CheckListening(ctx context.Context) (any, error) {
+	if s.draining.Load() {
+		return "draining", nil
+	}
+	if !s.listening.Load() {
+		return nil, errors.New("listeners are not open")
+	}
+	return fmt.Sprintf("%d listeners accepting", len(s.config.Listeners)), nil
+}
+
+// CheckAccepting is the readiness counterpart of CheckListening: a draining
+// proxy is alive but must not receive new clients
+func (s *Server) CheckAccepting(ctx context.Context) (any, error) {
+	if s.draining.Load() {
+		return nil, errors.New("draining, new sessions are not accepted")
+	}
+	if !s.listening.Load() {
+		return nil, errors.New("listeners are not open yet")
+	}
+	return "accepting", nil
+}
+
+// CheckUpstreams passes when at least one upstream primary accepts TCP
+// connections. The detail shows the state of every upstream.
+func (s *Server) CheckUpstreams(ctx context.Context) (any, error) {
+	var (
+		mu        sync.Mutex
+		wg        sync.WaitGroup
+		detail    = make(map[string]string, len(s.config.Upstreams))
+		reachable int
+	)
+	for name, upstream := range s.config.Upstreams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var dialer net.Dialer
+			conn, err := dialer.DialContext(ctx, "tcp", upstream.Address())
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				detail[name] = err.Error()
+				return
+			}
+			conn.Close()
+			detail[name] = "reachable"
+			reachable++
+		}()
+	}
+	wg.Wait()
+
+	if reachable == 0 {
+		return detail, errors.New("no upstream is reachable")
+	}
+	return detail, nil
+}
@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"net"
+	"os"
+	"time"
+
+	"gprxy/internal/config"
+	"gprxy/internal/logger"
+)
+
+// listen opens the socket for a configured listener
+func listen(l *config.Listener) (net.Listener, error) {
+	if l.Network == "unix" {
+		return listenUnix(l.Address, l.SocketMode)
+	}
+	ln, err := net.Listen("tcp", l.Address)
+	if err != nil {
+		return nil, logger.Errorf("failed to listen on %s: %w", l.Address, err)
+	}
+	return ln, nil
+}
+
+// listenUnix listens on a Unix socket and applies the configured permissions.
+// libpq expects the socket to be named .s.PGSQL.<port> inside host=<dir>.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	// A socket left behind by an unclean shutdown would make Listen fail,
+	// but one that still accepts connections belongs to a running proxy
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		conn, err := net.DialTimeout("unix", path, time.Second)
+		if err == nil {
+			conn.Close()
+			return nil, logger.Errorf("socket %s is in use by another process", path)
+		}
+		logger.Debug("removing stale socket %s", path)
+		os.Remove(path)
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, logger.Errorf("failed to listen on %s: %w", path, err)
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, logger.Errorf("failed to set permissions on %s: %w", path, err)
+	}
+	return ln, nil
+}
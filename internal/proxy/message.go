@@ -5,91 +5,282 @@ import (
 
 	"github.com/jackc/pgproto3/v2"
 
-	"gprxy/internal/logger"
+	"gprxy/internal/metrics"
 )
 
-// handleMessage handles incoming client messages after authentication
+// handleMessage handles incoming client messages after authentication. It is
+// the client-to-backend half of the relay: replies are relayed independently
+// by pumpBackend, so pipelined requests are forwarded without waiting for
+// earlier results.
 func (pc *Connection) handleMessage(client *pgproto3.Backend) error {
 	msg, err := client.Receive()
 	if err != nil {
-		return logger.Errorf("client receive error: %w", err)
+		return pc.log.Errorf("client receive error: %w", err)
 	}
 
-	key := pc.poolConn.Conn().PgConn().SecretKey()
-	pid := pc.poolConn.Conn().PgConn().PID()
 	switch query := msg.(type) {
 	case *pgproto3.Query:
-		logger.Info("[%s] query: %s", pc.user, query.String)
-		logger.Debug("query connection PID=%d, secret_key=%d", pid, key)
+		// Logged once routed so the line shows which server runs it
 
 	case *pgproto3.Parse:
-		logger.Debug("[%s] parse: statement='%s' query='%s'", pc.user, query.Name, query.Query)
+		pc.log.Debug("[%s] parse: statement='%s' query='%s'", pc.user, query.Name, pc.redactSQL(query.Query))
 
 	case *pgproto3.Describe:
 		objectType := "statement"
 		if query.ObjectType == 'P' {
 			objectType = "portal"
 		}
-		logger.Debug("[%s] describe: %s='%s'", pc.user, objectType, query.Name)
+		pc.log.Debug("[%s] describe: %s='%s'", pc.user, objectType, query.Name)
 
 	case *pgproto3.Bind:
 		paramCount := len(query.Parameters)
-		logger.Debug("[%s] bind: portal='%s' statement='%s' params=%d", pc.user, query.DestinationPortal, query.PreparedStatement, paramCount)
+		pc.log.Debug("[%s] bind: portal='%s' statement='%s' params=%d", pc.user, query.DestinationPortal, query.PreparedStatement, paramCount)
 
 	case *pgproto3.Execute:
 		maxRows := "unlimited"
 		if query.MaxRows > 0 {
 			maxRows = fmt.Sprintf("%d", query.MaxRows)
 		}
-		logger.Debug("[%s] execute: portal='%s' max_rows=%s", pc.user, query.Portal, maxRows)
+		pc.log.Debug("[%s] execute: portal='%s' max_rows=%s", pc.user, query.Portal, maxRows)
 
 	case *pgproto3.Sync:
-		logger.Debug("[%s] sync: transaction boundary", pc.user)
+		pc.log.Debug("[%s] sync: transaction boundary", pc.user)
+
+	case *pgproto3.FunctionCall:
+		pc.log.Debug("[%s] function call: oid=%d args=%d", pc.user, query.Function, len(query.Arguments))
+
+	case *pgproto3.CopyData, *pgproto3.CopyDone, *pgproto3.CopyFail:
+		// Counted per COPY and logged once it completes
 
 	case *pgproto3.Terminate:
-		logger.Info("[%s] client disconnecting gracefully", pc.user)
-		return logger.Errorf("client terminated")
+		pc.log.Info("[%s] client disconnecting gracefully", pc.user)
+		return pc.log.Errorf("client terminated")
 
 	default:
-		logger.Debug("[%s] unknown message type: %T", pc.user, query)
+		pc.log.Debug("[%s] unknown message type: %T", pc.user, query)
 	}
 
-	err = pc.bf.Send(msg)
-	if err != nil {
-		return logger.Errorf("unable to send query to backend: %w", err)
+	pc.mu.Lock()
+	busy := pc.replicaBusy(msg)
+	pc.mu.Unlock()
+	if busy != nil {
+		pc.log.Debug("[%s] waiting for the replica to finish before using the primary", pc.user)
+		<-busy
 	}
 
-	if _, ok := msg.(*pgproto3.Terminate); ok {
-		return logger.Errorf("connection terminated")
+	pc.mu.Lock()
+	bf, outbound, err := pc.routeMessage(client, msg)
+	route := pc.route
+	pc.mu.Unlock()
+
+	if query, ok := msg.(*pgproto3.Query); ok {
+		if route == "" {
+			route = "not forwarded"
+		}
+		pc.log.Info("[%s] query [%s]: %s", pc.user, route, pc.redactSQL(query.String))
+	}
+	if err != nil {
+		return err
 	}
 
-	return pc.relayBackendResponse(client)
+	// Backend writes happen outside the lock so the backend pump can keep
+	// draining replies while a large pipeline is being written
+	for _, out := range outbound {
+		err = bf.Send(out)
+		if err != nil {
+			return pc.log.Errorf("unable to send query to backend: %w", err)
+		}
+	}
+	return nil
 }
 
-// relayBackendResponse relays backend responses back to the client
-func (pc *Connection) relayBackendResponse(client *pgproto3.Backend) error {
-	for {
-		msg, err := pc.bf.Receive()
+// routeMessage decides how a client message is served: rejected, answered by
+// the proxy, or forwarded to a backend. It returns the backend frontend and the
+// messages to write to it, with their replies already queued. The caller must
+// hold pc.mu.
+func (pc *Connection) routeMessage(client *pgproto3.Backend, msg pgproto3.FrontendMessage) (*pgproto3.Frontend, []pgproto3.FrontendMessage, error) {
+	pc.outbound = pc.outbound[:0]
+
+	if pc.failedToSync {
+		if _, ok := msg.(*pgproto3.Sync); !ok {
+			// The backend skips it and sends no reply, so none is queued
+			pc.outbound = append(pc.outbound, msg)
+			return pc.bf, pc.outbound, nil
+		}
+		pc.failedToSync = false
+	}
+
+	pc.trackStatement(msg)
+
+	if pc.skipUntilSync {
+		if _, ok := msg.(*pgproto3.Sync); !ok {
+			return nil, nil, nil
+		}
+		pc.skipUntilSync = false
+		if pc.poolConn == nil {
+			pc.synthesizeReply('S', &pgproto3.ReadyForQuery{TxStatus: pc.txStatus})
+			return nil, nil, pc.flushSynthetic(client)
+		}
+		// Let the backend finish whatever the client sent before the
+		// rejected message
+		pc.queueToBackend(msg, replyForward, "")
+		return pc.bf, pc.outbound, nil
+	}
+
+	switch msg.(type) {
+	case *pgproto3.CopyData, *pgproto3.CopyDone, *pgproto3.CopyFail:
+		if !pc.acceptCopyMessage(msg) {
+			return nil, nil, nil
+		}
+		pc.queueToBackend(msg, replyForward, "")
+		return pc.bf, pc.outbound, nil
+	}
+
+	handled, err := pc.checkSessionState(msg)
+	if err != nil {
+		return nil, nil, err
+	}
+	if handled {
+		return nil, nil, pc.flushSynthetic(client)
+	}
+
+	if _, ok := msg.(*pgproto3.Flush); ok && !pc.flushNeeded() {
+		return nil, nil, nil
+	}
+
+	if pc.poolConn == nil {
+		err = pc.acquireBackend(pc.wantsReplica(msg))
 		if err != nil {
-			return logger.Errorf("backend receive error: %w", err)
+			pc.log.Error("failed to assign backend: %v", err)
+			return nil, nil, pc.sendErrorToClient(client, "Database unavailable")
 		}
+	}
+
+	if pc.config.PoolMode.SharesBackends() {
+		handled = pc.forwardStatementMessage(msg)
+	}
+	if !handled {
+		pc.queueToBackend(msg, replyForward, "")
+	}
+	return pc.bf, pc.outbound, pc.flushSynthetic(client)
+}
+
+// flushNeeded reports whether a Flush would make the backend send anything.
+// That is only the case while extended-protocol requests are outstanding
+// without a Sync behind them; a Sync flushes the backend by itself. In pooled
+// modes this also guarantees the backend cannot be released before the Flush
+// is written.
+func (pc *Connection) flushNeeded() bool {
+	if len(pc.replies) == 0 {
+		return false
+	}
+	switch pc.replies[len(pc.replies)-1].request {
+	case 'S', 'Q', 'F':
+		return false
+	}
+	return true
+}
+
+// relayMessage relays one backend message to the client, keeping the reply
+// queue in step. Asynchronous messages (NotificationResponse, NoticeResponse,
+// ParameterStatus) are not tied to a request and are relayed as they arrive,
+// including while the client is idle in session pooling mode. It returns the
+// backend if it was released from the client, in which case the calling pump
+// must stop reading from it and finish the release. The caller must hold
+// pc.mu.
+func (pc *Connection) relayMessage(client *pgproto3.Backend, msg pgproto3.BackendMessage) (*releasedBackend, error) {
+	err := pc.flushSynthetic(client)
+	if err != nil {
+		return nil, err
+	}
+
+	completed := false
+	swallow := false
+	if len(pc.replies) > 0 {
+		completed = pc.replies[0].completedBy(msg)
+		swallow = completed && pc.replies[0].kind == replySwallow
+	}
 
+	if !swallow {
 		err = client.Send(msg)
 		if err != nil {
-			return logger.Errorf("client send error: %w", err)
+			return nil, pc.log.Errorf("client send error: %w", err)
 		}
+	}
+
+	pc.traceReply(msg)
+	pc.auditReply(msg)
 
-		switch msgType := msg.(type) {
-		case *pgproto3.ReadyForQuery:
-			logger.Debug("query completed, ready for next query (status: %c)",
-				msgType.TxStatus)
-			return nil
-		case *pgproto3.ErrorResponse:
-			logger.Warn("query error: %s (code: %s)",
-				msgType.Message, msgType.Code)
-		case *pgproto3.CommandComplete:
-			logger.Debug("command completed: %s",
-				msgType.CommandTag)
+	switch msgType := msg.(type) {
+	case *pgproto3.ReadyForQuery:
+		pc.log.Debug("query completed, ready for next query (status: %c)",
+			msgType.TxStatus)
+	case *pgproto3.ErrorResponse:
+		pc.log.Warn("query error: %s (code: %s)",
+			msgType.Message, msgType.Code)
+		pc.failReply(msgType.Code)
+		pc.finishCopy(false)
+	case *pgproto3.CommandComplete:
+		pc.log.Debug("command completed: %s",
+			msgType.CommandTag)
+		if len(pc.replies) > 0 && pc.replies[0].kind == replyForward {
+			metrics.QueryDuration.WithLabelValues(metrics.CommandLabel(string(msgType.CommandTag))).
+				Observe(metrics.Since(pc.replies[0].sent))
 		}
+		if string(msgType.CommandTag) == "ROLLBACK" {
+			// Also the tag of a COMMIT that ended a failed transaction
+			pc.rolledBack = true
+		}
+		pc.finishCopy(true)
+	case *pgproto3.CopyInResponse:
+		pc.startCopy("in")
+	case *pgproto3.CopyOutResponse:
+		pc.startCopy("out")
+	case *pgproto3.CopyBothResponse:
+		pc.startCopy("both")
+	case *pgproto3.CopyData:
+		pc.countCopyOut(msgType)
+	case *pgproto3.FunctionCallResponse:
+		pc.log.Debug("[%s] function call returned %d bytes", pc.user, len(msgType.Result))
+	case *pgproto3.NotificationResponse:
+		pc.log.Debug("[%s] notification on channel '%s' from backend PID=%d", pc.user, msgType.Channel, msgType.PID)
+	case *pgproto3.NoticeResponse:
+		pc.log.Debug("[%s] notice: %s", pc.user, msgType.Message)
+	case *pgproto3.ParameterStatus:
+		pc.log.Debug("[%s] parameter status: %s = %s", pc.user, msgType.Name, msgType.Value)
+	}
+
+	if completed {
+		pc.completeReply()
+		if ready, ok := msg.(*pgproto3.ReadyForQuery); ok {
+			pc.finishCycle(ready.TxStatus)
+		}
+	}
+
+	err = pc.flushSynthetic(client)
+	if err != nil {
+		return nil, err
+	}
+
+	// In transaction and statement pooling modes the backend is released as
+	// soon as it reports the session idle with nothing left in flight. Only
+	// its ReadyForQuery says so: mid-cycle the queue can be empty, after an
+	// error discarded the replies or before the client has sent its Sync.
+	ready, ok := msg.(*pgproto3.ReadyForQuery)
+	if !ok || ready.TxStatus != 'I' || len(pc.replies) > 0 {
+		return nil, nil
 	}
+	pc.closeIfDraining()
+	if pc.config.PoolMode.SharesBackends() {
+		return pc.releaseBackend(), nil
+	}
+	return nil, nil
+}
+
+// finishCycle runs once the client has been told the backend is ready for the
+// next request
+func (pc *Connection) finishCycle(txStatus byte) {
+	pc.txStatus = txStatus
+	pc.commitSessionSets(txStatus, pc.cycleFailed)
+	pc.cycleFailed = false
 }
@@ -0,0 +1,428 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgproto3/v2"
+
+	"gprxy/internal/config"
+	"gprxy/internal/logger"
+)
+
+// backendScript answers one client message on a scripted backend connection
+type backendScript func(b *pgproto3.Backend, msg pgproto3.FrontendMessage)
+
+// scriptedBackend stands in for PostgreSQL. Every connection it accepts
+// completes the startup and answers pgx's pings by itself; all other messages
+// are passed to a script of its own, which replies through the backend it is
+// given. Simple queries and parsed statements are recorded in the order they
+// arrive.
+type scriptedBackend struct {
+	host, port string
+	newScript  func() backendScript
+
+	mu      sync.Mutex
+	queries []string
+	parsed  []string
+}
+
+func startScriptedBackend(t *testing.T, newScript func() backendScript) *scriptedBackend {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	sb := &scriptedBackend{newScript: newScript}
+	sb.host, sb.port, _ = net.SplitHostPort(ln.Addr().String())
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+			go sb.serve(conn)
+		}
+	}()
+	return sb
+}
+
+func (sb *scriptedBackend) serve(conn net.Conn) {
+	b := pgproto3.NewBackend(pgproto3.NewChunkReader(conn), conn)
+	if _, err := b.ReceiveStartupMessage(); err != nil {
+		return
+	}
+	b.Send(&pgproto3.AuthenticationOk{})
+	b.Send(&pgproto3.BackendKeyData{ProcessID: 1, SecretKey: 1})
+	b.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+
+	script := sb.newScript()
+	for {
+		msg, err := b.Receive()
+		if err != nil {
+			return
+		}
+		if q, ok := msg.(*pgproto3.Query); ok && q.String == "-- ping" {
+			b.Send(&pgproto3.EmptyQueryResponse{})
+			b.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+			continue
+		}
+		sb.mu.Lock()
+		switch m := msg.(type) {
+		case *pgproto3.Query:
+			sb.queries = append(sb.queries, m.String)
+		case *pgproto3.Parse:
+			sb.parsed = append(sb.parsed, m.Query)
+		}
+		sb.mu.Unlock()
+		script(b, msg)
+	}
+}
+
+// received returns the simple queries the backend has been sent so far
+func (sb *scriptedBackend) received() []string {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return append([]string{}, sb.queries...)
+}
+
+// parses returns how many times the backend has been asked to parse a query
+func (sb *scriptedBackend) parses(query string) int {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	n := 0
+	for _, q := range sb.parsed {
+		if q == query {
+			n++
+		}
+	}
+	return n
+}
+
+// postgresScript answers like PostgreSQL would for a handful of statements:
+// a Parse of the query "bad" fails and everything up to the next Sync is
+// skipped, BEGIN and COMMIT move the transaction status, and other requests
+// succeed without rows.
+func postgresScript() backendScript {
+	failed := false
+	txStatus := byte('I')
+	return func(b *pgproto3.Backend, msg pgproto3.FrontendMessage) {
+		if _, ok := msg.(*pgproto3.Sync); ok {
+			failed = false
+			b.Send(&pgproto3.ReadyForQuery{TxStatus: txStatus})
+			return
+		}
+		if failed {
+			return
+		}
+		switch m := msg.(type) {
+		case *pgproto3.Parse:
+			if m.Query == "bad" {
+				failed = true
+				b.Send(&pgproto3.ErrorResponse{Severity: "ERROR", Code: "42601", Message: "syntax error"})
+				return
+			}
+			b.Send(&pgproto3.ParseComplete{})
+		case *pgproto3.Bind:
+			b.Send(&pgproto3.BindComplete{})
+		case *pgproto3.Describe:
+			b.Send(&pgproto3.NoData{})
+		case *pgproto3.Execute:
+			b.Send(&pgproto3.CommandComplete{CommandTag: []byte("SELECT 0")})
+		case *pgproto3.Close:
+			b.Send(&pgproto3.CloseComplete{})
+		case *pgproto3.Query:
+			tag := "SELECT 0"
+			switch word := strings.ToUpper(strings.Fields(m.String + " x")[0]); word {
+			case "BEGIN":
+				tag, txStatus = word, 'T'
+			case "COMMIT":
+				tag, txStatus = word, 'I'
+			case "SET", "RESET":
+				tag = word
+			}
+			b.Send(&pgproto3.CommandComplete{CommandTag: []byte(tag)})
+			b.Send(&pgproto3.ReadyForQuery{TxStatus: txStatus})
+		}
+	}
+}
+
+// startPooledSession serves one authenticated client in the given pooling mode
+// against the scripted backend, and any scripted replicas, skipping the
+// startup. It returns the client's protocol handle and the proxy side of the
+// session.
+func startPooledSession(t *testing.T, mode config.PoolMode, sb *scriptedBackend, replicas ...*scriptedBackend) (*pgproto3.Frontend, *Connection) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	clientConn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	proxyConn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+
+	// Pools are shared process-wide, so every backend gets its own upstream
+	upstream := &config.Upstream{Name: t.Name() + "-" + sb.port, Host: sb.host, Port: sb.port, SSLMode: "disable"}
+	for _, replica := range replicas {
+		upstream.Replicas = append(upstream.Replicas, net.JoinHostPort(replica.host, replica.port))
+	}
+	pc := &Connection{
+		conn:       proxyConn,
+		config:     &config.Config{PoolMode: mode, Upstreams: map[string]*config.Upstream{upstream.Name: upstream}},
+		listener:   &config.Listener{Name: config.DefaultListener},
+		log:        logger.With("test", t.Name()),
+		ctx:        context.Background(),
+		user:       "alice",
+		db:         "orders",
+		upstream:   upstream,
+		txStatus:   'I',
+		statements: make(map[string]*preparedStatement),
+	}
+	pc.client = pgproto3.NewBackend(pgproto3.NewChunkReader(proxyConn), proxyConn)
+	go func() {
+		for pc.handleMessage(pc.client) == nil {
+		}
+		pc.closeClient()
+		pc.stopBackendPump()
+	}()
+	t.Cleanup(func() { clientConn.Close() })
+
+	return pgproto3.NewFrontend(pgproto3.NewChunkReader(clientConn), clientConn), pc
+}
+
+// send writes client messages to the proxy
+func send(t *testing.T, client *pgproto3.Frontend, msgs ...pgproto3.FrontendMessage) {
+	t.Helper()
+	for _, msg := range msgs {
+		if err := client.Send(msg); err != nil {
+			t.Fatalf("send %T: %v", msg, err)
+		}
+	}
+}
+
+// expect reads the next messages from the proxy and checks their types
+func expect(t *testing.T, client *pgproto3.Frontend, want ...pgproto3.BackendMessage) []pgproto3.BackendMessage {
+	t.Helper()
+	var got []pgproto3.BackendMessage
+	for _, w := range want {
+		msg, err := client.Receive()
+		if err != nil {
+			t.Fatalf("receive, expecting %T: %v", w, err)
+		}
+		if reflect.TypeOf(msg) != reflect.TypeOf(w) {
+			t.Fatalf("received %T, expected %T", msg, w)
+		}
+		got = append(got, msg)
+	}
+	return got
+}
+
+// waitReleased waits for the session to hand its backend back to the pool with
+// nothing left in its reply queue
+func waitReleased(t *testing.T, pc *Connection) {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		pc.mu.Lock()
+		held, pending := pc.poolConn != nil, len(pc.replies)
+		pc.mu.Unlock()
+		if !held && pending == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("backend not released: held=%v, %d replies pending", held, pending)
+		}
+	}
+}
+
+// TestErrorBeforeSyncRouted sends a failing Parse on its own and the rest of
+// the cycle only once its error has been relayed, as a pipelining driver may.
+// The backend skips the late Bind and Execute, so the proxy must not wait for
+// replies to them: the Sync's ReadyForQuery ends the cycle and releases the
+// backend.
+func TestErrorBeforeSyncRouted(t *testing.T) {
+	sb := startScriptedBackend(t, postgresScript)
+	client, pc := startPooledSession(t, config.PoolModeTransaction, sb)
+
+	send(t, client, &pgproto3.Parse{Query: "bad"}, &pgproto3.Flush{})
+	expect(t, client, &pgproto3.ErrorResponse{})
+
+	send(t, client, &pgproto3.Bind{}, &pgproto3.Execute{}, &pgproto3.Sync{})
+	expect(t, client, &pgproto3.ReadyForQuery{})
+	waitReleased(t, pc)
+
+	// The next cycle is answered in step
+	send(t, client, &pgproto3.Parse{Query: "SELECT 1"}, &pgproto3.Bind{}, &pgproto3.Execute{}, &pgproto3.Sync{})
+	expect(t, client, &pgproto3.ParseComplete{}, &pgproto3.BindComplete{}, &pgproto3.CommandComplete{}, &pgproto3.ReadyForQuery{})
+	waitReleased(t, pc)
+}
+
+// TestTransactionHoldsBackend checks a transaction keeps its backend across
+// request cycles and that a SET committed in it is replayed on the backend
+// assigned for the next transaction
+func TestTransactionHoldsBackend(t *testing.T) {
+	sb := startScriptedBackend(t, postgresScript)
+	client, pc := startPooledSession(t, config.PoolModeTransaction, sb)
+
+	send(t, client, &pgproto3.Query{String: "BEGIN"})
+	expect(t, client, &pgproto3.CommandComplete{}, &pgproto3.ReadyForQuery{})
+	send(t, client, &pgproto3.Query{String: "SET search_path = audit"})
+	expect(t, client, &pgproto3.CommandComplete{}, &pgproto3.ReadyForQuery{})
+
+	pc.mu.Lock()
+	held := pc.poolConn != nil
+	pc.mu.Unlock()
+	if !held {
+		t.Fatal("backend released inside a transaction")
+	}
+
+	send(t, client, &pgproto3.Query{String: "COMMIT"})
+	expect(t, client, &pgproto3.CommandComplete{}, &pgproto3.ReadyForQuery{})
+	waitReleased(t, pc)
+
+	send(t, client, &pgproto3.Query{String: "SELECT 1"})
+	expect(t, client, &pgproto3.CommandComplete{}, &pgproto3.ReadyForQuery{})
+	waitReleased(t, pc)
+
+	// The settings are undone after each release, which the client does
+	// not wait for
+	want := []string{
+		"BEGIN", "SET search_path = audit", "COMMIT", "RESET ALL; RESET ROLE",
+		"SET search_path = audit", "SELECT 1", "RESET ALL; RESET ROLE",
+	}
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		got := sb.received()
+		if reflect.DeepEqual(got, want) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("backend received %q, want %q", got, want)
+		}
+	}
+}
+
+// TestPipelinedQueriesReleaseOnce pipelines simple queries and an extended
+// cycle without waiting for replies and checks each is answered in order
+// before the backend goes back to the pool
+func TestPipelinedQueriesReleaseOnce(t *testing.T) {
+	sb := startScriptedBackend(t, postgresScript)
+	client, pc := startPooledSession(t, config.PoolModeTransaction, sb)
+
+	send(t, client,
+		&pgproto3.Query{String: "SELECT 1"},
+		&pgproto3.Parse{Query: "SELECT 2"}, &pgproto3.Bind{}, &pgproto3.Execute{}, &pgproto3.Sync{},
+		&pgproto3.Query{String: "SELECT 3"},
+	)
+	expect(t, client,
+		&pgproto3.CommandComplete{}, &pgproto3.ReadyForQuery{},
+		&pgproto3.ParseComplete{}, &pgproto3.BindComplete{}, &pgproto3.CommandComplete{}, &pgproto3.ReadyForQuery{},
+		&pgproto3.CommandComplete{}, &pgproto3.ReadyForQuery{},
+	)
+	waitReleased(t, pc)
+}
+
+// TestFailedParseUnmarked checks a statement the backend never prepared, because
+// its Parse failed or was skipped after an earlier error, is parsed again the
+// next time rather than answered with a synthetic ParseComplete
+func TestFailedParseUnmarked(t *testing.T) {
+	sb := startScriptedBackend(t, postgresScript)
+	client, pc := startPooledSession(t, config.PoolModeTransaction, sb)
+
+	send(t, client, &pgproto3.Parse{Name: "s1", Query: "bad"}, &pgproto3.Sync{})
+	expect(t, client, &pgproto3.ErrorResponse{}, &pgproto3.ReadyForQuery{})
+	waitReleased(t, pc)
+
+	// The same query under another name must reach the backend and fail
+	// again, and the first name is free to reuse
+	send(t, client,
+		&pgproto3.Parse{Name: "s2", Query: "bad"}, &pgproto3.Sync{},
+		&pgproto3.Parse{Name: "s1", Query: "SELECT 1"}, &pgproto3.Sync{},
+	)
+	expect(t, client,
+		&pgproto3.ErrorResponse{}, &pgproto3.ReadyForQuery{},
+		&pgproto3.ParseComplete{}, &pgproto3.ReadyForQuery{},
+	)
+	waitReleased(t, pc)
+	if n := sb.parses("bad"); n != 2 {
+		t.Fatalf("backend parsed the failing query %d times, want 2", n)
+	}
+
+	// A Parse skipped after the error is parsed again as well
+	send(t, client, &pgproto3.Parse{Query: "bad"}, &pgproto3.Parse{Name: "s3", Query: "SELECT 2"}, &pgproto3.Sync{})
+	expect(t, client, &pgproto3.ErrorResponse{}, &pgproto3.ReadyForQuery{})
+	waitReleased(t, pc)
+	send(t, client, &pgproto3.Parse{Name: "s3", Query: "SELECT 2"}, &pgproto3.Sync{})
+	expect(t, client, &pgproto3.ParseComplete{}, &pgproto3.ReadyForQuery{})
+	waitReleased(t, pc)
+	if n := sb.parses("SELECT 2"); n != 2 {
+		t.Fatalf("backend parsed the skipped query %d times, want 2", n)
+	}
+}
+
+// TestDiscardRejected checks DISCARD, which would drop the statements other
+// clients have prepared on a shared backend, never reaches it
+func TestDiscardRejected(t *testing.T) {
+	sb := startScriptedBackend(t, postgresScript)
+	client, pc := startPooledSession(t, config.PoolModeTransaction, sb)
+
+	send(t, client, &pgproto3.Query{String: "SELECT 1; DISCARD ALL"})
+	got := expect(t, client, &pgproto3.ErrorResponse{}, &pgproto3.ReadyForQuery{})
+	if code := got[0].(*pgproto3.ErrorResponse).Code; code != featureNotSupported {
+		t.Fatalf("DISCARD failed with %s, want %s", code, featureNotSupported)
+	}
+
+	send(t, client, &pgproto3.Parse{Query: "discard plans"}, &pgproto3.Sync{})
+	expect(t, client, &pgproto3.ErrorResponse{}, &pgproto3.ReadyForQuery{})
+	waitReleased(t, pc)
+
+	if got := sb.received(); len(got) != 0 {
+		t.Fatalf("backend received %q", got)
+	}
+	if n := sb.parses("discard plans"); n != 0 {
+		t.Fatalf("backend parsed DISCARD %d times", n)
+	}
+}
+
+// TestWriteWaitsForReplica pipelines an extended cycle behind a read-only
+// query. The query runs on the replica, and the cycle must wait for it and run
+// on the primary rather than follow it onto the replica.
+func TestWriteWaitsForReplica(t *testing.T) {
+	primary := startScriptedBackend(t, postgresScript)
+	replica := startScriptedBackend(t, postgresScript)
+	client, pc := startPooledSession(t, config.PoolModeTransaction, primary, replica)
+
+	send(t, client,
+		&pgproto3.Query{String: "SELECT 1"},
+		&pgproto3.Parse{Query: "INSERT INTO t VALUES (1)"}, &pgproto3.Bind{}, &pgproto3.Execute{}, &pgproto3.Sync{},
+	)
+	expect(t, client,
+		&pgproto3.CommandComplete{}, &pgproto3.ReadyForQuery{},
+		&pgproto3.ParseComplete{}, &pgproto3.BindComplete{}, &pgproto3.CommandComplete{}, &pgproto3.ReadyForQuery{},
+	)
+	waitReleased(t, pc)
+
+	if got := replica.received(); !reflect.DeepEqual(got, []string{"SELECT 1"}) {
+		t.Fatalf("replica received %q", got)
+	}
+	if n := replica.parses("INSERT INTO t VALUES (1)"); n != 0 {
+		t.Fatal("replica was sent the write")
+	}
+	if n := primary.parses("INSERT INTO t VALUES (1)"); n != 1 {
+		t.Fatalf("primary parsed the write %d times, want 1", n)
+	}
+}
@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/jackc/pgproto3/v2"
+
+	"gprxy/internal/pool"
+)
+
+// duplicatePreparedStatement is the SQLSTATE PostgreSQL reports for a Parse
+// reusing the name of an existing statement
+const duplicatePreparedStatement = "42P05"
+
+// preparedStatement is a named statement as the client prepared it
+type preparedStatement struct {
+	name      string
+	query     string
+	paramOIDs []uint32
+}
+
+// serverStatementName derives the backend-side name for a statement from its
+// text, its parameter types and the session settings in effect when it is
+// used. Clients preparing the same statement under the same settings share
+// one backend statement, while a client with a different search_path or other
+// SETs gets its own, so a statement never resolves names under another
+// client's settings. Different statements can never collide no matter what
+// names the clients chose.
+func serverStatementName(query string, paramOIDs []uint32, settings []string) string {
+	h := sha256.New()
+	writeString := func(s string) {
+		binary.Write(h, binary.BigEndian, uint32(len(s)))
+		h.Write([]byte(s))
+	}
+	writeString(query)
+	binary.Write(h, binary.BigEndian, uint32(len(paramOIDs)))
+	for _, oid := range paramOIDs {
+		binary.Write(h, binary.BigEndian, oid)
+	}
+	for _, setting := range settings {
+		writeString(setting)
+	}
+	return "gprxy_" + hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// serverName returns the backend-side name of a client statement under the
+// session settings currently applied to the client's backend
+func (pc *Connection) serverName(stmt *preparedStatement) string {
+	settings := pc.sessionSets
+	if len(pc.pendingSets) > 0 {
+		settings = append(append([]string{}, pc.sessionSets...), pc.pendingSets...)
+	}
+	return serverStatementName(stmt.query, stmt.paramOIDs, settings)
+}
+
+// registerStatement records a client's named Parse. The message is copied
+// since pgproto3 reuses it for the next Parse it receives.
+func (pc *Connection) registerStatement(parse *pgproto3.Parse) *preparedStatement {
+	stmt := &preparedStatement{
+		name:      parse.Name,
+		query:     parse.Query,
+		paramOIDs: append([]uint32(nil), parse.ParameterOIDs...),
+	}
+	pc.statements[stmt.name] = stmt
+	pc.log.Debug("[%s] registered prepared statement '%s'", pc.user, stmt.name)
+	return stmt
+}
+
+// ensurePrepared re-issues a client's statement on the current backend if the
+// backend does not hold it yet and returns its backend-side name. The
+// backend's ParseComplete is swallowed since the client never sent this Parse.
+func (pc *Connection) ensurePrepared(stmt *preparedStatement) string {
+	serverName := pc.serverName(stmt)
+	if pool.IsPrepared(pc.poolConn, serverName) {
+		return serverName
+	}
+
+	pc.log.Debug("[%s] preparing statement '%s' as '%s' on backend PID=%d", pc.user, stmt.name, serverName, pc.poolConn.Conn().PgConn().PID())
+	pool.MarkPrepared(pc.poolConn, serverName)
+	pc.queueToBackend(&pgproto3.Parse{
+		Name:          serverName,
+		Query:         stmt.query,
+		ParameterOIDs: stmt.paramOIDs,
+	}, replySwallow, serverName)
+	return serverName
+}
+
+// forwardStatementMessage forwards an extended-protocol message that refers to
+// a named prepared statement, translating client statement names to backend
+// names and preparing statements on the current backend when needed. It
+// returns false for messages it does not handle.
+func (pc *Connection) forwardStatementMessage(msg pgproto3.FrontendMessage) bool {
+	switch m := msg.(type) {
+	case *pgproto3.Parse:
+		if m.Name == "" {
+			return false
+		}
+		if _, exists := pc.statements[m.Name]; exists {
+			pc.rejectMessage(m, duplicatePreparedStatement, fmt.Sprintf("prepared statement \"%s\" already exists", m.Name))
+			return true
+		}
+		stmt := pc.registerStatement(m)
+		serverName := pc.serverName(stmt)
+		if pool.IsPrepared(pc.poolConn, serverName) {
+			pc.synthesizeReply('P', &pgproto3.ParseComplete{})
+		} else {
+			pool.MarkPrepared(pc.poolConn, serverName)
+			pc.queueToBackend(&pgproto3.Parse{
+				Name:          serverName,
+				Query:         stmt.query,
+				ParameterOIDs: stmt.paramOIDs,
+			}, replyForward, serverName)
+		}
+		// A Parse that fails, or is skipped after an earlier error, must
+		// not leave the name taken
+		pc.replies[len(pc.replies)-1].statement = stmt.name
+		return true
+
+	case *pgproto3.Bind:
+		stmt, exists := pc.statements[m.PreparedStatement]
+		if !exists {
+			return false
+		}
+		bind := *m
+		bind.PreparedStatement = pc.ensurePrepared(stmt)
+		pc.queueToBackend(&bind, replyForward, "")
+		return true
+
+	case *pgproto3.Describe:
+		if m.ObjectType != 'S' {
+			return false
+		}
+		stmt, exists := pc.statements[m.Name]
+		if !exists {
+			return false
+		}
+		serverName := pc.ensurePrepared(stmt)
+		pc.queueToBackend(&pgproto3.Describe{ObjectType: 'S', Name: serverName}, replyForward, "")
+		return true
+
+	case *pgproto3.Close:
+		if m.ObjectType != 'S' {
+			return false
+		}
+		if _, exists := pc.statements[m.Name]; !exists {
+			return false
+		}
+		// The backend statement may be shared with other clients, so it
+		// stays prepared and only the client's name goes away
+		delete(pc.statements, m.Name)
+		pc.synthesizeReply('C', &pgproto3.CloseComplete{})
+		return true
+	}
+	return false
+}
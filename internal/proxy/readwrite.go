@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"strings"
+
+	"github.com/jackc/pgproto3/v2"
+)
+
+// readOnlySession reports whether a client's startup parameters ask for a
+// read-only session, either through default_transaction_read_only or a libpq
+// style target_session_attrs
+func readOnlySession(params map[string]string) bool {
+	switch strings.ToLower(params["target_session_attrs"]) {
+	case "read-only", "standby", "prefer-standby":
+		return true
+	}
+	switch strings.ToLower(params["default_transaction_read_only"]) {
+	case "on", "true", "yes", "1":
+		return true
+	}
+	return false
+}
+
+// isReadOnlyQuery reports whether every statement in a simple query is a plain
+// read that a replica can serve. Anything the scanner is unsure about, such as
+// SELECT INTO, row locking clauses or data-modifying CTEs, stays on the
+// primary. Volatile functions with side effects cannot be detected from the
+// text, so clients calling them from a bare SELECT should use a transaction.
+func isReadOnlyQuery(sql string) bool {
+	statements := splitStatements(sql)
+	if len(statements) == 0 {
+		return false
+	}
+
+	for _, stmt := range statements {
+		words := statementKeywords(stmt)
+		if len(words) == 0 {
+			return false
+		}
+		switch words[0] {
+		case "select", "values", "table", "with":
+		case "show":
+			continue
+		default:
+			return false
+		}
+
+		for i, word := range words {
+			switch word {
+			case "into", "insert", "update", "delete", "merge", "nextval", "setval":
+				return false
+			case "for":
+				if i+1 < len(words) && (words[i+1] == "share" || words[i+1] == "no" || words[i+1] == "key") {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+// wantsReplica reports whether the backend for a new transaction opened by msg
+// should come from a replica: always for read-only sessions, otherwise only for
+// autocommit simple queries that only read. Extended-protocol messages are
+// routed to the primary since the rest of the implicit transaction is not known
+// when the backend is assigned. The caller must hold pc.mu.
+func (pc *Connection) wantsReplica(msg pgproto3.FrontendMessage) bool {
+	if len(pc.upstream.Replicas) == 0 {
+		return false
+	}
+	if pc.readOnly {
+		return true
+	}
+	query, ok := msg.(*pgproto3.Query)
+	return ok && isReadOnlyQuery(query.String)
+}
+
+// replicaBusy returns a channel to wait on before routing msg when the client
+// still holds a replica backend for earlier autocommit reads and msg needs the
+// primary. It is closed once the backend pump has relayed the replica's last
+// reply and released it, so msg is assigned a primary backend instead of
+// failing on the replica. The caller must hold pc.mu.
+func (pc *Connection) replicaBusy(msg pgproto3.FrontendMessage) <-chan struct{} {
+	if pc.poolConn == nil || !pc.onReplica || pc.readOnly || pc.wantsReplica(msg) {
+		return nil
+	}
+	return pc.pumpDone
+}
@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"time"
+
+	"github.com/jackc/pgproto3/v2"
+	"go.opentelemetry.io/otel/trace"
+
+	"gprxy/internal/pool"
+)
+
+// replyKind says what the relay does with the reply to a request
+type replyKind int
+
+const (
+	// replyForward relays the backend's reply to the client
+	replyForward replyKind = iota
+	// replySwallow drops the backend's reply to a request the proxy injected
+	replySwallow
+	// replySynthesize emits a reply generated by the proxy without involving
+	// the backend
+	replySynthesize
+)
+
+// pendingReply is one outstanding request whose reply has not been relayed
+// yet. The queue of pending replies mirrors the order of requests on the wire,
+// so the relay knows where each backend reply ends and where proxy-generated
+// replies belong in the stream.
+type pendingReply struct {
+	kind      replyKind
+	request   byte                    // Wire type of the request ('P', 'B', 'D', 'E', 'C', 'S', 'Q', 'F')
+	synthetic pgproto3.BackendMessage // Reply sent to the client for replySynthesize
+	prepared  string                  // Server-side statement created by this request, if any
+	statement string                  // Client statement name registered by this request, if any
+	sent      time.Time               // When the request was queued for the backend
+	span      trace.Span              // Round trip span for forwarded queries and executes
+	audit     *auditEntry             // Audit record for forwarded queries and executes, if auditing
+}
+
+// requestType returns the wire type of a frontend message that produces a reply
+// and false for messages that do not
+func requestType(msg pgproto3.FrontendMessage) (byte, bool) {
+	switch msg.(type) {
+	case *pgproto3.Parse:
+		return 'P', true
+	case *pgproto3.Bind:
+		return 'B', true
+	case *pgproto3.Describe:
+		return 'D', true
+	case *pgproto3.Execute:
+		return 'E', true
+	case *pgproto3.Close:
+		return 'C', true
+	case *pgproto3.Sync:
+		return 'S', true
+	case *pgproto3.Query:
+		return 'Q', true
+	case *pgproto3.FunctionCall:
+		return 'F', true
+	}
+	return 0, false
+}
+
+// completedBy reports whether msg is the final backend message in the reply to
+// the request
+func (r *pendingReply) completedBy(msg pgproto3.BackendMessage) bool {
+	switch msg.(type) {
+	case *pgproto3.ParseComplete:
+		return r.request == 'P'
+	case *pgproto3.BindComplete:
+		return r.request == 'B'
+	case *pgproto3.CloseComplete:
+		return r.request == 'C'
+	case *pgproto3.RowDescription, *pgproto3.NoData:
+		return r.request == 'D'
+	case *pgproto3.CommandComplete, *pgproto3.EmptyQueryResponse, *pgproto3.PortalSuspended:
+		return r.request == 'E'
+	case *pgproto3.ReadyForQuery:
+		return r.request == 'S' || r.request == 'Q' || r.request == 'F'
+	}
+	return false
+}
+
+// queueToBackend queues a request for writing to the backend and records its
+// reply. Replies are queued before the request is written so the backend pump
+// always finds them.
+func (pc *Connection) queueToBackend(msg pgproto3.FrontendMessage, kind replyKind, prepared string) {
+	pc.outbound = append(pc.outbound, msg)
+	if request, ok := requestType(msg); ok {
+		reply := pendingReply{kind: kind, request: request, prepared: prepared, sent: time.Now()}
+		if kind == replyForward && (request == 'Q' || request == 'E') {
+			reply.span = pc.startQuerySpan(request)
+			reply.audit = pc.startAudit(msg)
+		}
+		pc.replies = append(pc.replies, reply)
+	}
+}
+
+// synthesizeReply queues a reply the proxy answers on the backend's behalf
+func (pc *Connection) synthesizeReply(request byte, reply pgproto3.BackendMessage) {
+	pc.replies = append(pc.replies, pendingReply{kind: replySynthesize, request: request, synthetic: reply})
+}
+
+// flushSynthetic sends proxy-generated replies at the head of the queue. They
+// are due as soon as every earlier reply has been relayed.
+func (pc *Connection) flushSynthetic(client *pgproto3.Backend) error {
+	for len(pc.replies) > 0 && pc.replies[0].kind == replySynthesize {
+		err := client.Send(pc.replies[0].synthetic)
+		if err != nil {
+			return pc.log.Errorf("client send error: %w", err)
+		}
+		reply := pc.replies[0].synthetic
+		pc.replies = pc.replies[1:]
+		if ready, ok := reply.(*pgproto3.ReadyForQuery); ok {
+			pc.finishCycle(ready.TxStatus)
+		}
+	}
+	return nil
+}
+
+// completeReply pops the head of the queue once its reply has been relayed
+func (pc *Connection) completeReply() {
+	endReplySpan(&pc.replies[0])
+	pc.finishAudit(&pc.replies[0], "", false)
+	pc.replies = pc.replies[1:]
+}
+
+// failReply handles an ErrorResponse for the request at the head of the queue.
+// The backend ignores every further extended-protocol message until Sync, so
+// their replies are dropped, any statements they would have created are
+// forgotten and skipped executes are audited with the error's code. If the
+// error overtook the client's Sync, the messages still to come up to it are
+// skipped in routeMessage.
+func (pc *Connection) failReply(code string) {
+	pc.cycleFailed = true
+	if len(pc.replies) == 0 {
+		return
+	}
+	switch pc.replies[0].request {
+	case 'S', 'Q', 'F':
+		// ReadyForQuery still follows
+		return
+	}
+
+	for len(pc.replies) > 0 && pc.replies[0].request != 'S' {
+		if pc.replies[0].prepared != "" && pc.poolConn != nil {
+			pool.UnmarkPrepared(pc.poolConn, pc.replies[0].prepared)
+		}
+		if pc.replies[0].statement != "" {
+			delete(pc.statements, pc.replies[0].statement)
+		}
+		endReplySpan(&pc.replies[0])
+		pc.finishAudit(&pc.replies[0], code, false)
+		pc.replies = pc.replies[1:]
+	}
+	if len(pc.replies) == 0 {
+		// The client has not sent the Sync yet; whatever it sends before
+		// it will be skipped too
+		pc.failedToSync = true
+	}
+}
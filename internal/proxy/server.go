@@ -2,20 +2,29 @@ package proxy
 
 import (
 	"context"
+	"crypto/rand"
 	"crypto/tls"
+	"encoding/hex"
 	"net"
 	"sync"
+	"sync/atomic"
 
+	"gprxy/internal/audit"
 	"gprxy/internal/config"
 	"gprxy/internal/logger"
+	"gprxy/internal/metrics"
 )
 
 // Server represents the proxy server
 type Server struct {
 	config            *config.Config
 	tlsConfig         *tls.Config
+	audit             *audit.Log
 	activeConnections map[uint64]*Connection
 	connMutex         sync.RWMutex
+
+	listening atomic.Bool // Every listener is open and accepting
+	draining  atomic.Bool // Shutdown started, existing sessions are finishing
 }
 
 // Combines ProcessID and SecretKey into a single uint64:
@@ -29,11 +38,10 @@ func (s *Server) registerConnection(processId, secretkey uint32, conn *Connectio
 	defer s.connMutex.Unlock()
 	key := s.makeCancelKey(processId, secretkey)
 	s.activeConnections[key] = conn
-	logger.Debug("registered connection: PID=%d, secret_key=%d, map_key=%d", processId, secretkey, key)
+	conn.log.Debug("registered connection: PID=%d, secret_key=%d, map_key=%d", processId, secretkey, key)
 	logger.Debug("active connections in registry: %d", len(s.activeConnections))
 	for k, v := range s.activeConnections {
-		logger.Debug("registry entry: key=%d, user=%s, db=%s, secret_key=%v, pid=%v",
-			k, v.user, v.db, v.poolConn.Conn().PgConn().SecretKey(), v.poolConn.Conn().PgConn().PID())
+		logger.Debug("registry entry: key=%d, user=%s, db=%s", k, v.user, v.db)
 	}
 }
 
@@ -66,61 +74,133 @@ func (s *Server) getConnectionForCancelRequest(processId, secretkey uint32) (*Co
 	return conn, exists
 }
 
-// NewServer creates a new proxy server
-func NewServer(cfg *config.Config, tls *tls.Config) *Server {
+// NewServer creates a new proxy server. Statements are audited to auditLog
+// unless it is nil.
+func NewServer(cfg *config.Config, tls *tls.Config, auditLog *audit.Log) *Server {
 	return &Server{
 		config:            cfg,
 		tlsConfig:         tls,
+		audit:             auditLog,
 		activeConnections: make(map[uint64]*Connection),
 	}
 }
 
 // Start starts the proxy server and listens for client connections
 func (s *Server) Start(ctx context.Context) error {
-	listenAddr := net.JoinHostPort(s.config.ProxyHost, s.config.ProxyPort)
-	ln, err := net.Listen("tcp", listenAddr)
-	if err != nil {
-		return logger.Errorf("failed to start proxy server: %w", err)
+	listeners := make([]net.Listener, 0, len(s.config.Listeners))
+	for _, l := range s.config.Listeners {
+		ln, err := listen(l)
+		if err != nil {
+			for _, opened := range listeners {
+				opened.Close()
+			}
+			return logger.Errorf("failed to start proxy server: %w", err)
+		}
+		listeners = append(listeners, ln)
 	}
 
+	s.listening.Store(true)
+
 	go func() {
 		<-ctx.Done()
+		s.draining.Store(true)
+		s.listening.Store(false)
 		logger.Info("shutdown signal received, stopping listener")
-		ln.Close()
+		for _, ln := range listeners {
+			ln.Close()
+		}
+		s.closeIdleConnections()
 	}()
 
 	var wg sync.WaitGroup
-	tlsStatus := "disabled"
-	if s.tlsConfig != nil {
-		tlsStatus = "enabled"
+	var accepting sync.WaitGroup
+	for i, ln := range listeners {
+		l := s.config.Listeners[i]
+		tlsStatus := "disabled"
+		if s.tlsConfig != nil && l.TLSMode != config.TLSModeDisable {
+			tlsStatus = string(l.TLSMode)
+		}
+		upstream := l.Upstream
+		if upstream == "" {
+			upstream = "routed"
+		}
+		logger.Info("PostgreSQL proxy listening on %s [%s] (TLS: %s, auth: %s, upstream: %s)",
+			ln.Addr(), l.Name, tlsStatus, l.Auth, upstream)
+		accepting.Add(1)
+		go func() {
+			defer accepting.Done()
+			s.acceptConnections(ctx, ln, l, &wg)
+		}()
 	}
-	logger.Info("PostgreSQL proxy listening on %s (TLS: %s)", ln.Addr(), tlsStatus)
+	accepting.Wait()
+
+	logger.Info("listner closed, waiting for active connections to drain")
+	wg.Wait()
+	logger.Info("all connnections drained, shutdown complete")
+	return nil
+}
+
+// closeIdleConnections ends the sessions of clients that are between
+// transactions once draining has started. Busy clients are closed by
+// closeIfDraining when their current transaction finishes.
+func (s *Server) closeIdleConnections() {
+	s.connMutex.RLock()
+	conns := make([]*Connection, 0, len(s.activeConnections))
+	for _, pc := range s.activeConnections {
+		conns = append(conns, pc)
+	}
+	s.connMutex.RUnlock()
+
+	for _, pc := range conns {
+		pc.mu.Lock()
+		pc.closeIfDraining()
+		pc.mu.Unlock()
+	}
+}
+
+// newConnectionID returns a random ID that tags every log line of one client
+// connection
+func newConnectionID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		// Unreachable on supported platforms; an untagged connection is
+		// still better than refusing it
+		return "unknown"
+	}
+	return hex.EncodeToString(id)
+}
 
+// acceptConnections serves clients from one listener until ctx is cancelled
+func (s *Server) acceptConnections(ctx context.Context, ln net.Listener, l *config.Listener, wg *sync.WaitGroup) {
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
 			select {
 			case <-ctx.Done():
-				logger.Info("listner closed, waiting for active connections to drain")
-				wg.Wait()
-				logger.Info("all connnections drained, shutdown complete")
-				return nil
+				return
 			default:
 				logger.Error("failed to accept connection: %v", err)
 				continue
 			}
 		}
 
+		metrics.ClientConnectionsAccepted.WithLabelValues(l.Name).Inc()
+		id := newConnectionID()
 		pc := &Connection{
-			conn:      conn,
-			config:    s.config,
-			tlsConfig: s.tlsConfig,
-			server:    s,
+			conn:       metrics.CountBytes(conn, l.Name),
+			id:         id,
+			log:        logger.With("conn_id", id, "client", conn.RemoteAddr().String(), "listener", l.Name),
+			config:     s.config,
+			listener:   l,
+			tlsConfig:  s.tlsConfig,
+			server:     s,
+			audit:      s.audit,
+			statements: make(map[string]*preparedStatement),
 		}
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			go pc.handleConnection()
+			pc.handleConnection()
 		}()
 	}
 }
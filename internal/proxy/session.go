@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"fmt"
+
+	"github.com/jackc/pgproto3/v2"
+
+	"gprxy/internal/config"
+)
+
+// sessionResetQuery undoes tracked session settings before a backend goes back
+// to the pool. RESET ALL does not cover the role, so that is reset separately.
+const sessionResetQuery = "RESET ALL; RESET ROLE"
+
+// statementKind classifies a statement by the session state it depends on
+type statementKind int
+
+const (
+	stmtOther statementKind = iota
+	stmtSessionSet
+	stmtSetRole
+	stmtListen
+	stmtPrepare
+	stmtDiscard
+	stmtBegin
+)
+
+// classifyStatement inspects the leading keywords of a single SQL statement
+func classifyStatement(stmt string) statementKind {
+	words := leadingKeywords(stmt, 3)
+	if len(words) == 0 {
+		return stmtOther
+	}
+
+	switch words[0] {
+	case "set":
+		// SET LOCAL, SET TRANSACTION and SET CONSTRAINTS only last until the
+		// end of the current transaction
+		if len(words) > 1 && (words[1] == "local" || words[1] == "transaction" || words[1] == "constraints") {
+			return stmtOther
+		}
+		if len(words) > 1 && words[1] == "role" ||
+			len(words) > 2 && words[1] == "session" && (words[2] == "role" || words[2] == "authorization") {
+			return stmtSetRole
+		}
+		return stmtSessionSet
+	case "reset":
+		return stmtSessionSet
+	case "listen":
+		return stmtListen
+	case "prepare", "deallocate":
+		return stmtPrepare
+	case "discard":
+		return stmtDiscard
+	case "begin":
+		return stmtBegin
+	case "start":
+		if len(words) > 1 && words[1] == "transaction" {
+			return stmtBegin
+		}
+	}
+	return stmtOther
+}
+
+// checkSessionState inspects a client message for features that depend on
+// backend session state. In transaction and statement pooling modes
+// session-level SET/RESET statements are tracked so they can be replayed on
+// whichever backend serves the next request, while LISTEN, SQL-level PREPARE,
+// DISCARD and role changes, which RESET ALL cannot undo, are rejected with an
+// ErrorResponse. Statement pooling also refuses explicit transaction blocks.
+// A SET sent through the extended protocol is tracked when a portal of its
+// statement is executed, not when it is parsed. It returns true if the
+// message was handled and must not be forwarded to the backend.
+func (pc *Connection) checkSessionState(msg pgproto3.FrontendMessage) (bool, error) {
+	mode := pc.config.PoolMode
+	if !mode.SharesBackends() {
+		return false, nil
+	}
+
+	var sql string
+	switch m := msg.(type) {
+	case *pgproto3.Query:
+		sql = m.String
+	case *pgproto3.Parse:
+		sql = m.Query
+	case *pgproto3.Bind, *pgproto3.Execute, *pgproto3.Close:
+		pc.trackExtendedSets(msg)
+		return false, nil
+	default:
+		return false, nil
+	}
+
+	var sets []string
+	for _, stmt := range splitStatements(sql) {
+		switch classifyStatement(stmt) {
+		case stmtSessionSet:
+			sets = append(sets, stmt)
+		case stmtSetRole:
+			return true, pc.rejectMessage(msg, featureNotSupported,
+				fmt.Sprintf("SET ROLE and SET SESSION AUTHORIZATION are not supported in %s pooling mode", mode))
+		case stmtListen:
+			return true, pc.rejectMessage(msg, featureNotSupported,
+				fmt.Sprintf("LISTEN is not supported in %s pooling mode", mode))
+		case stmtPrepare:
+			return true, pc.rejectMessage(msg, featureNotSupported,
+				fmt.Sprintf("PREPARE and DEALLOCATE are not supported in %s pooling mode", mode))
+		case stmtDiscard:
+			// DISCARD ALL would drop statements other clients share
+			return true, pc.rejectMessage(msg, featureNotSupported,
+				fmt.Sprintf("DISCARD is not supported in %s pooling mode", mode))
+		case stmtBegin:
+			if mode == config.PoolModeStatement {
+				return true, pc.rejectMessage(msg, featureNotSupported,
+					"transaction blocks are not allowed in statement pooling mode")
+			}
+		}
+	}
+
+	if parse, ok := msg.(*pgproto3.Parse); ok {
+		// A Parse reusing a live statement name fails and leaves the
+		// statement as it was
+		if _, exists := pc.statements[parse.Name]; !exists || parse.Name == "" {
+			pc.recordStatementSets(parse.Name, sets)
+		}
+		return false, nil
+	}
+	if len(sets) > 0 {
+		pc.log.Debug("[%s] tracking session settings: %v", pc.user, sets)
+		pc.pendingSets = append(pc.pendingSets, sets...)
+	}
+	return false, nil
+}
+
+// recordStatementSets remembers the session settings a parsed statement makes
+// when executed
+func (pc *Connection) recordStatementSets(name string, sets []string) {
+	if len(sets) == 0 {
+		delete(pc.statementSets, name)
+		return
+	}
+	if pc.statementSets == nil {
+		pc.statementSets = make(map[string][]string)
+		pc.portalSets = make(map[string][]string)
+	}
+	pc.statementSets[name] = sets
+}
+
+// trackExtendedSets follows the session settings of parsed statements through
+// Bind to the Execute that runs them, where they start pending like those of
+// a simple query
+func (pc *Connection) trackExtendedSets(msg pgproto3.FrontendMessage) {
+	if pc.statementSets == nil {
+		return
+	}
+	switch m := msg.(type) {
+	case *pgproto3.Bind:
+		if sets, ok := pc.statementSets[m.PreparedStatement]; ok {
+			pc.portalSets[m.DestinationPortal] = sets
+		} else {
+			delete(pc.portalSets, m.DestinationPortal)
+		}
+	case *pgproto3.Execute:
+		if sets := pc.portalSets[m.Portal]; len(sets) > 0 {
+			pc.log.Debug("[%s] tracking session settings: %v", pc.user, sets)
+			pc.pendingSets = append(pc.pendingSets, sets...)
+		}
+	case *pgproto3.Close:
+		if m.ObjectType == 'S' {
+			delete(pc.statementSets, m.Name)
+		} else {
+			delete(pc.portalSets, m.Name)
+		}
+	}
+}
+
+// commitSessionSets settles pending SET/RESET statements once the backend has
+// reported the request cycle finished. They stay pending while a transaction
+// is open and are recorded once the session is idle again, unless the
+// transaction rolled back or failed, in which case PostgreSQL has undone them.
+func (pc *Connection) commitSessionSets(txStatus byte, failed bool) {
+	rolledBack := pc.rolledBack
+	if txStatus == 'T' {
+		// A ROLLBACK that leaves the transaction open was ROLLBACK TO
+		// SAVEPOINT
+		pc.rolledBack = false
+		return
+	}
+	pc.rolledBack = false
+	if len(pc.pendingSets) == 0 {
+		return
+	}
+	if txStatus == 'I' && !failed && !rolledBack {
+		pc.sessionSets = append(pc.sessionSets, pc.pendingSets...)
+	} else {
+		pc.log.Debug("[%s] dropping %d session settings undone by rollback", pc.user, len(pc.pendingSets))
+	}
+	pc.pendingSets = nil
+}
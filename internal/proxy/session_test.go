@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/jackc/pgproto3/v2"
+
+	"gprxy/internal/config"
+	"gprxy/internal/logger"
+)
+
+// pooledConnection returns a connection in transaction pooling mode with no
+// client or backend attached, for driving the routing state directly
+func pooledConnection() *Connection {
+	return &Connection{
+		config:     &config.Config{PoolMode: config.PoolModeTransaction},
+		log:        logger.With(),
+		statements: make(map[string]*preparedStatement),
+		txStatus:   'I',
+	}
+}
+
+func TestParsedSetTrackedWhenExecuted(t *testing.T) {
+	pc := pooledConnection()
+
+	for _, msg := range []pgproto3.FrontendMessage{
+		&pgproto3.Parse{Name: "never_run", Query: "SET search_path = audit"},
+		&pgproto3.Parse{Name: "run", Query: "SET statement_timeout = 0"},
+		&pgproto3.Bind{PreparedStatement: "run"},
+	} {
+		if handled, err := pc.checkSessionState(msg); handled || err != nil {
+			t.Fatalf("%T: handled=%v err=%v", msg, handled, err)
+		}
+	}
+	if len(pc.pendingSets) != 0 {
+		t.Fatalf("settings tracked before Execute: %v", pc.pendingSets)
+	}
+
+	pc.checkSessionState(&pgproto3.Execute{})
+	if len(pc.pendingSets) != 1 || pc.pendingSets[0] != "SET statement_timeout = 0" {
+		t.Fatalf("pending settings after Execute = %v", pc.pendingSets)
+	}
+
+	pc.commitSessionSets('I', false)
+	if len(pc.sessionSets) != 1 {
+		t.Fatalf("session settings after commit = %v", pc.sessionSets)
+	}
+}
+
+func TestRoleChangesRejected(t *testing.T) {
+	for _, sql := range []string{
+		"SET ROLE admin",
+		"set session role admin",
+		"SET SESSION AUTHORIZATION admin",
+		"SELECT 1; SET role = 'admin'",
+	} {
+		pc := pooledConnection()
+		handled, err := pc.checkSessionState(&pgproto3.Query{String: sql})
+		if !handled || err != nil {
+			t.Fatalf("%q: handled=%v err=%v", sql, handled, err)
+		}
+		reply, ok := pc.replies[0].synthetic.(*pgproto3.ErrorResponse)
+		if !ok || reply.Code != featureNotSupported {
+			t.Errorf("%q: expected a %s error, got %#v", sql, featureNotSupported, pc.replies[0].synthetic)
+		}
+		if len(pc.pendingSets) != 0 {
+			t.Errorf("%q: tracked %v", sql, pc.pendingSets)
+		}
+	}
+
+	pc := pooledConnection()
+	for _, sql := range []string{"SET LOCAL ROLE admin", "RESET ROLE"} {
+		if handled, _ := pc.checkSessionState(&pgproto3.Query{String: sql}); handled {
+			t.Errorf("%q rejected", sql)
+		}
+	}
+}
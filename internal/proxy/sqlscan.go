@@ -0,0 +1,259 @@
+package proxy
+
+import (
+	"strings"
+	"unicode"
+)
+
+// splitStatements splits a simple-query string into its individual statements.
+// Semicolons inside quoted identifiers, string literals, dollar-quoted bodies
+// and comments are not treated as separators. Empty statements are dropped.
+func splitStatements(sql string) []string {
+	var statements []string
+	start := 0
+
+	for i := 0; i < len(sql); {
+		switch {
+		case sql[i] == '\'':
+			i = skipStringLiteral(sql, i)
+		case sql[i] == '"':
+			i = skipQuoted(sql, i, '"')
+		case strings.HasPrefix(sql[i:], "--"):
+			i = skipLineComment(sql, i)
+		case strings.HasPrefix(sql[i:], "/*"):
+			i = skipBlockComment(sql, i)
+		case sql[i] == '$':
+			i = skipDollarQuoted(sql, i)
+		case sql[i] == ';':
+			if stmt := strings.TrimSpace(sql[start:i]); stmt != "" {
+				statements = append(statements, stmt)
+			}
+			i++
+			start = i
+		default:
+			i++
+		}
+	}
+
+	if stmt := strings.TrimSpace(sql[start:]); stmt != "" {
+		statements = append(statements, stmt)
+	}
+	return statements
+}
+
+// leadingKeywords returns up to n lower-cased words at the start of a
+// statement, skipping any leading whitespace and comments
+func leadingKeywords(stmt string, n int) []string {
+	words := make([]string, 0, n)
+
+	for i := 0; i < len(stmt) && len(words) < n; {
+		switch {
+		case unicode.IsSpace(rune(stmt[i])):
+			i++
+		case strings.HasPrefix(stmt[i:], "--"):
+			i = skipLineComment(stmt, i)
+		case strings.HasPrefix(stmt[i:], "/*"):
+			i = skipBlockComment(stmt, i)
+		case isWordByte(stmt[i]):
+			j := i
+			for j < len(stmt) && isWordByte(stmt[j]) {
+				j++
+			}
+			words = append(words, strings.ToLower(stmt[i:j]))
+			i = j
+		default:
+			return words
+		}
+	}
+	return words
+}
+
+// statementKeywords returns every lower-cased bare word in a statement,
+// skipping quoted identifiers, string literals, dollar-quoted bodies and
+// comments
+func statementKeywords(stmt string) []string {
+	var words []string
+
+	for i := 0; i < len(stmt); {
+		switch {
+		case stmt[i] == '\'':
+			i = skipStringLiteral(stmt, i)
+		case stmt[i] == '"':
+			i = skipQuoted(stmt, i, '"')
+		case strings.HasPrefix(stmt[i:], "--"):
+			i = skipLineComment(stmt, i)
+		case strings.HasPrefix(stmt[i:], "/*"):
+			i = skipBlockComment(stmt, i)
+		case stmt[i] == '$':
+			i = skipDollarQuoted(stmt, i)
+		case isWordByte(stmt[i]):
+			j := i
+			for j < len(stmt) && isWordByte(stmt[j]) {
+				j++
+			}
+			words = append(words, strings.ToLower(stmt[i:j]))
+			i = j
+		default:
+			i++
+		}
+	}
+	return words
+}
+
+func isWordByte(b byte) bool {
+	return b == '_' || b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9'
+}
+
+// skipQuoted returns the index just past a quoted token that starts at i,
+// honouring doubled quote characters as escapes
+func skipQuoted(sql string, i int, quote byte) int {
+	for j := i + 1; j < len(sql); j++ {
+		if sql[j] != quote {
+			continue
+		}
+		if j+1 < len(sql) && sql[j+1] == quote {
+			j++
+			continue
+		}
+		return j + 1
+	}
+	return len(sql)
+}
+
+// skipStringLiteral returns the index just past a string literal whose opening
+// quote is at i. In an E'...' escape string a backslash also escapes the
+// character after it, quotes included.
+func skipStringLiteral(sql string, i int) int {
+	escapes := i > 0 && (sql[i-1] == 'E' || sql[i-1] == 'e') && (i == 1 || !isWordByte(sql[i-2]))
+	if !escapes {
+		return skipQuoted(sql, i, '\'')
+	}
+	for j := i + 1; j < len(sql); j++ {
+		switch sql[j] {
+		case '\\':
+			j++
+		case '\'':
+			if j+1 < len(sql) && sql[j+1] == '\'' {
+				j++
+				continue
+			}
+			return j + 1
+		}
+	}
+	return len(sql)
+}
+
+func skipLineComment(sql string, i int) int {
+	if end := strings.IndexByte(sql[i:], '\n'); end >= 0 {
+		return i + end + 1
+	}
+	return len(sql)
+}
+
+func skipBlockComment(sql string, i int) int {
+	depth := 0
+	for j := i; j < len(sql)-1; j++ {
+		switch {
+		case sql[j] == '/' && sql[j+1] == '*':
+			depth++
+			j++
+		case sql[j] == '*' && sql[j+1] == '/':
+			depth--
+			j++
+			if depth == 0 {
+				return j + 1
+			}
+		}
+	}
+	return len(sql)
+}
+
+// skipDollarQuoted returns the index just past a $tag$...$tag$ body starting at
+// i. A '$' that does not open a dollar quote (e.g. a $1 parameter) is skipped
+// on its own.
+func skipDollarQuoted(sql string, i int) int {
+	end := i + 1
+	for end < len(sql) && (isWordByte(sql[end]) && !(end == i+1 && sql[end] >= '0' && sql[end] <= '9')) {
+		end++
+	}
+	if end >= len(sql) || sql[end] != '$' {
+		return i + 1
+	}
+
+	tag := sql[i : end+1]
+	if close := strings.Index(sql[end+1:], tag); close >= 0 {
+		return end + 1 + close + len(tag)
+	}
+	return len(sql)
+}
+
+// redactLiterals replaces the contents of string literals and dollar-quoted
+// bodies with '?', and numeric literals too if numbers is set. Identifiers,
+// keywords, comments and $n parameters are kept, so the statement's shape
+// survives without the values in it.
+func redactLiterals(sql string, numbers bool) string {
+	var b strings.Builder
+	b.Grow(len(sql))
+
+	for i := 0; i < len(sql); {
+		switch {
+		case sql[i] == '\'':
+			end := skipStringLiteral(sql, i)
+			b.WriteString("'?'")
+			i = end
+		case sql[i] == '"':
+			end := skipQuoted(sql, i, '"')
+			b.WriteString(sql[i:end])
+			i = end
+		case strings.HasPrefix(sql[i:], "--"):
+			end := skipLineComment(sql, i)
+			b.WriteString(sql[i:end])
+			i = end
+		case strings.HasPrefix(sql[i:], "/*"):
+			end := skipBlockComment(sql, i)
+			b.WriteString(sql[i:end])
+			i = end
+		case sql[i] == '$':
+			end := skipDollarQuoted(sql, i)
+			if end == i+1 {
+				// A parameter such as $1 rather than a dollar quote
+				for end < len(sql) && sql[end] >= '0' && sql[end] <= '9' {
+					end++
+				}
+				b.WriteString(sql[i:end])
+			} else {
+				b.WriteString("'?'")
+			}
+			i = end
+		case numbers && isNumberStart(sql, i):
+			end := i + 1
+			for end < len(sql) && (isWordByte(sql[end]) || sql[end] == '.' ||
+				(sql[end] == '+' || sql[end] == '-') && (sql[end-1] == 'e' || sql[end-1] == 'E')) {
+				end++
+			}
+			b.WriteByte('?')
+			i = end
+		case isWordByte(sql[i]):
+			end := i
+			for end < len(sql) && isWordByte(sql[end]) {
+				end++
+			}
+			b.WriteString(sql[i:end])
+			i = end
+		default:
+			b.WriteByte(sql[i])
+			i++
+		}
+	}
+	return b.String()
+}
+
+// isNumberStart reports whether a numeric literal starts at i, as opposed to
+// a digit inside an identifier
+func isNumberStart(sql string, i int) bool {
+	digit := func(j int) bool { return j < len(sql) && sql[j] >= '0' && sql[j] <= '9' }
+	if !digit(i) && !(sql[i] == '.' && digit(i+1)) {
+		return false
+	}
+	return i == 0 || !isWordByte(sql[i-1]) && sql[i-1] != '.'
+}
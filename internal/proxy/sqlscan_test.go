@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRedactLiterals(t *testing.T) {
+	tests := []struct {
+		name    string
+		sql     string
+		numbers bool
+		want    string
+	}{
+		{"string", "SELECT * FROM users WHERE name = 'alice'", false, "SELECT * FROM users WHERE name = '?'"},
+		{"doubled quote", "SELECT 'it''s secret'", false, "SELECT '?'"},
+		{"escape string", `SELECT E'pa\'ss123'`, false, `SELECT E'?'`},
+		{"lower-case escape string", `SELECT e'pa\'ss123' AS x`, false, `SELECT e'?' AS x`},
+		{"escaped backslash", `SELECT E'a\\', 'b'`, false, `SELECT E'?', '?'`},
+		{"backslash outside escape string", `SELECT 'C:\', 'b'`, false, `SELECT '?', '?'`},
+		{"identifier ending in e", `SELECT name'x'`, false, `SELECT name'?'`},
+		{"dollar quote", "SELECT $$it's $1$$, $fn$a $$ b$fn$", false, "SELECT '?', '?'"},
+		{"nested comment", "SELECT /* outer /* 'inner' */ 'still comment' */ 'x'", false, "SELECT /* outer /* 'inner' */ 'still comment' */ '?'"},
+		{"line comment", "SELECT 'x' -- don't\n, 1", true, "SELECT '?' -- don't\n, ?"},
+		{"parameters", "SELECT * FROM t WHERE id = $1 AND name = $12", true, "SELECT * FROM t WHERE id = $1 AND name = $12"},
+		{"numbers kept", "SELECT * FROM t1 WHERE id = 42 LIMIT 10", false, "SELECT * FROM t1 WHERE id = 42 LIMIT 10"},
+		{"numbers", "SELECT * FROM t1 WHERE id = 42 AND x > -1.5e-3 AND y < .5", true, "SELECT * FROM t1 WHERE id = ? AND x > -? AND y < ?"},
+		{"quoted identifier", `SELECT "col'1" FROM t WHERE "x" = 'y'`, true, `SELECT "col'1" FROM t WHERE "x" = '?'`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := redactLiterals(tt.sql, tt.numbers)
+			if got != tt.want {
+				t.Errorf("redactLiterals(%q) = %q, want %q", tt.sql, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitStatementsEscapeString(t *testing.T) {
+	got := splitStatements(`SET application_name = E'a\';b'; SELECT 1`)
+	want := []string{`SET application_name = E'a\';b'`, "SELECT 1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("splitStatements = %q, want %q", got, want)
+	}
+}
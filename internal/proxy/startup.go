@@ -1,116 +1,215 @@
 package proxy
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 
 	"time"
 
 	"gprxy/internal/auth"
-	"gprxy/internal/logger"
+	"gprxy/internal/config"
+	"gprxy/internal/metrics"
+	"gprxy/internal/pool"
 
 	"github.com/jackc/pgproto3/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// clientCertificate returns the client certificate verified during the TLS
+// handshake, if the client presented one
+func (pc *Connection) clientCertificate() *x509.Certificate {
+	tlsConn, ok := pc.conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
+
+// tlsPolicyAllows reports whether the client may start a session on its
+// current connection under its listener's TLS policy
+func (pc *Connection) tlsPolicyAllows() bool {
+	if pc.listener.TLSMode != config.TLSModeRequire {
+		return true
+	}
+	if _, ok := pc.conn.(*tls.Conn); ok {
+		return true
+	}
+	// libpq never requests TLS over a Unix socket, and the socket's file
+	// permissions already decide who may connect
+	if pc.conn.LocalAddr().Network() == "unix" {
+		return true
+	}
+	return pc.listener.TLSExemptAddr(pc.conn.RemoteAddr())
+}
+
 // handleStartupMessage handles the initial client startup message
 func (pc *Connection) handleStartupMessage(pgconn *pgproto3.Backend) (*pgproto3.Backend, error) {
 	clientAddr := pc.conn.RemoteAddr().String()
 
 	startupMessage, err := pgconn.ReceiveStartupMessage()
 	if err != nil {
-		return nil, logger.Errorf("error receiving startup message: %w", err)
+		return nil, pc.log.Errorf("error receiving startup message: %w", err)
 	}
 
-	logger.Debug("received startup message type: %T", startupMessage)
+	pc.log.Debug("received startup message type: %T", startupMessage)
 
 	switch msg := startupMessage.(type) {
 	case *pgproto3.StartupMessage:
+		received := time.Now()
+		result := "failure"
+		defer func() {
+			metrics.StartupDuration.WithLabelValues(result).Observe(metrics.Since(received))
+		}()
+
+		if !pc.tlsPolicyAllows() {
+			pc.log.Warn("refusing plaintext startup from %s: TLS is required", clientAddr)
+			return nil, pc.sendFatalToClient(pgconn, invalidAuthorization, "TLS connection required by gprxy (use sslmode=require)")
+		}
+
 		user := msg.Parameters["user"]
 		database := msg.Parameters["database"]
 		appName := msg.Parameters["application_name"]
-		logger.Info("connection request - user: %s, database: %s, app: %s",
-			user, database, appName)
+		pc.log.Info("connection request - user: %s, database: %s, app: %s, listener: %s",
+			user, database, appName, pc.listener.Name)
 
-		keyData, err := auth.AuthenticateUser(user, database, pc.config.DBHost, msg, pgconn, clientAddr)
-		if err != nil {
-			return nil, err
+		upstream, backendDB := pc.config.Route(database)
+		if pc.listener.Upstream != "" {
+			// Listeners bound to an upstream bypass the routing table
+			upstream, backendDB = pc.config.Upstreams[pc.listener.Upstream], database
 		}
-		logger.Info("user %s authenticated successfully", user)
-		pc.key = &keyData
-		start := time.Now()
-		err = pc.connectBackend(database, user)
-		if err != nil {
-			logger.Error("failed to connect to backend: %v", err)
-			return nil, pc.sendErrorToClient(pgconn, "Database unavailable")
+		pc.upstream = upstream
+		if backendDB != database {
+			pc.log.Debug("database %s routed to upstream %s (%s) as %s", database, upstream.Name, upstream.Address(), backendDB)
+		} else {
+			pc.log.Debug("database %s routed to upstream %s (%s)", database, upstream.Name, upstream.Address())
 		}
-		// _, err = pc.poolConn.Exec(context.Background(), fmt.Sprintf("SET ROLE %s", user))
-		// if err != nil {
-		// 	pc.poolConn.Conn().Close(context.Background())
-		// 	return nil, pc.sendErrorToClient(pgconn, "failed to assume user role")
+		database = backendDB
 
-		// }
-		logger.Debug("backend connection established in %v", time.Since(start))
-		underlyingConn := pc.poolConn.Conn().PgConn().Conn()
+		// target_session_attrs is a client-side libpq option the server does
+		// not accept, so it only steers replica routing
+		pc.readOnly = readOnlySession(msg.Parameters)
+		delete(msg.Parameters, "target_session_attrs")
 
-		bf := pgproto3.NewFrontend(pgproto3.NewChunkReader(underlyingConn), underlyingConn)
-		pc.bf = bf
+		keyData, identity, err := auth.AuthenticateUser(pc.ctx, pc.log, user, database, pc.upstream, pc.listener.Auth, pc.clientCertificate(), msg, pgconn, clientAddr)
+		if err != nil {
+			return nil, err
+		}
+		pc.log.Info("user %s authenticated successfully", user)
+		trace.SpanFromContext(pc.ctx).SetAttributes(
+			attribute.String("db.user", user),
+			attribute.String("db.name", database),
+			attribute.String("gprxy.upstream", pc.upstream.Name),
+		)
+		pc.key = &keyData
+		pc.identity = identity
 		pc.user = user
 		pc.db = database
+		pc.appName = appName
+		pc.txStatus = 'I'
 
-		backendPID := pc.poolConn.Conn().PgConn().PID()
-		backendSecretKey := pc.poolConn.Conn().PgConn().SecretKey()
+		if pc.config.PoolMode == config.PoolModeSession {
+			start := time.Now()
+			err = pc.connectBackend(database, user, pc.readOnly)
+			if err != nil {
+				pc.log.Error("failed to connect to backend: %v", err)
+				return nil, pc.sendErrorToClient(pgconn, "Database unavailable")
+			}
+			if set := pc.traceSetting(); set != "" {
+				_, err = pc.poolConn.Exec(context.Background(), set)
+				if err != nil {
+					pc.log.Error("failed to label backend session: %v", err)
+					pc.discardBackend()
+					return nil, pc.sendErrorToClient(pgconn, "Database unavailable")
+				}
+			}
+			// _, err = pc.poolConn.Exec(context.Background(), fmt.Sprintf("SET ROLE %s", user))
+			// if err != nil {
+			// 	pc.poolConn.Conn().Close(context.Background())
+			// 	return nil, pc.sendErrorToClient(pgconn, "failed to assume user role")
+
+			// }
+			pc.log.Debug("backend connection established in %v", time.Since(start))
+
+			backendPID := pc.poolConn.Conn().PgConn().PID()
+			backendSecretKey := pc.poolConn.Conn().PgConn().SecretKey()
 
-		pc.key = &pgproto3.BackendKeyData{
-			ProcessID: uint32(backendPID),
-			SecretKey: uint32(backendSecretKey),
+			pc.key = &pgproto3.BackendKeyData{
+				ProcessID: uint32(backendPID),
+				SecretKey: uint32(backendSecretKey),
+			}
+			pc.log.Debug("pool connection backend key: PID=%d, secret_key=%d", backendPID, backendSecretKey)
+		} else {
+			// Backends are assigned per request, so make sure the pool is
+			// usable now and hand the client a proxy-issued cancel key
+			_, err = pool.GetOrCreatePool(pc.log, pc.upstream.Name, user, database, pc.config.BuildConnectionString(pc.upstream, database))
+			if err != nil {
+				pc.log.Error("failed to create backend pool: %v", err)
+				return nil, pc.sendErrorToClient(pgconn, "Database unavailable")
+			}
+			pc.key, err = newProxyKey()
+			if err != nil {
+				return nil, pc.sendErrorToClient(pgconn, "Internal error")
+			}
+			pc.log.Debug("%s pooling mode, issued proxy backend key: PID=%d, secret_key=%d",
+				pc.config.PoolMode, pc.key.ProcessID, pc.key.SecretKey)
 		}
 
-		logger.Debug("pool connection backend key: PID=%d, secret_key=%d", backendPID, backendSecretKey)
 		err = pgconn.Send(pc.key)
 		if err != nil {
-			logger.Error("failed to send BackendKeyData to client: %v", err)
-			return nil, logger.Errorf("failed to send backend key data")
+			pc.log.Error("failed to send BackendKeyData to client: %v", err)
+			return nil, pc.log.Errorf("failed to send backend key data")
 		}
-		logger.Debug("sent pool BackendKeyData to client")
+		pc.log.Debug("sent pool BackendKeyData to client")
 
 		// Now send ReadyForQuery to complete the startup sequence
 		readyMsg := &pgproto3.ReadyForQuery{TxStatus: 'I'} // 'I' = idle
 		err = pgconn.Send(readyMsg)
 		if err != nil {
-			logger.Error("failed to send ReadyForQuery to client: %v", err)
-			return nil, logger.Errorf("failed to send ready for query")
+			pc.log.Error("failed to send ReadyForQuery to client: %v", err)
+			return nil, pc.log.Errorf("failed to send ready for query")
 		}
-		logger.Debug("sent ReadyForQuery to client")
+		pc.log.Debug("sent ReadyForQuery to client")
 
 		if pc.key != nil && pc.server != nil {
 			pc.server.registerConnection(pc.key.ProcessID, pc.key.SecretKey, pc)
-			logger.Debug("registered connection: PID=%d, secret_key=%d",
+			pc.log.Debug("registered connection: PID=%d, secret_key=%d",
 				pc.key.ProcessID, pc.key.SecretKey)
 		}
+		result = "success"
 	case *pgproto3.SSLRequest:
-		logger.Debug("SSL request received")
+		pc.log.Debug("SSL request received")
 
-		if pc.tlsConfig == nil {
-			logger.Debug("SSL not configured, rejecting request")
+		if _, ok := pc.conn.(*tls.Conn); ok {
+			return nil, pc.log.Errorf("SSLRequest received on an encrypted connection")
+		}
+
+		if pc.tlsConfig == nil || pc.listener.TLSMode == config.TLSModeDisable {
+			pc.log.Debug("SSL not configured, rejecting request")
 			_, err := pc.conn.Write([]byte{'N'})
 			if err != nil {
-				return nil, logger.Errorf("failed to send SSL rejection: %w", err)
+				return nil, pc.log.Errorf("failed to send SSL rejection: %w", err)
 			}
 			return pc.handleStartupMessage(pgconn)
 		}
 
-		logger.Debug("SSL configured, upgrading connection to TLS")
+		pc.log.Debug("SSL configured, upgrading connection to TLS")
 		_, err := pc.conn.Write([]byte{'S'})
 		if err != nil {
-			return nil, logger.Errorf("failed to send SSL acceptance: %w", err)
+			return nil, pc.log.Errorf("failed to send SSL acceptance: %w", err)
 		}
 
-		tlsConn := tls.Server(pc.conn, pc.tlsConfig)
-		err = tlsConn.Handshake()
+		tlsConn, err := pc.handshakeTLS(pc.conn, false)
 		if err != nil {
-			return nil, logger.Errorf("TLS handshake failed: %w", err)
+			return nil, pc.log.Errorf("TLS handshake failed: %w", err)
 		}
 
-		logger.Debug("TLS handshake completed successfully")
+		pc.log.Debug("TLS handshake completed successfully")
 
 		pc.conn = tlsConn
 
@@ -118,23 +217,47 @@ func (pc *Connection) handleStartupMessage(pgconn *pgproto3.Backend) (*pgproto3.
 
 		return pc.handleStartupMessage(pgconn)
 
+	case *pgproto3.GSSEncRequest:
+		// libpq asks for GSSAPI encryption first by default (gssencmode=prefer)
+		// and falls back to SSLRequest or a plain startup when refused
+		pc.log.Debug("GSSAPI encryption request received, rejecting (not supported)")
+		_, err := pc.conn.Write([]byte{'N'})
+		if err != nil {
+			return nil, pc.log.Errorf("failed to send GSSAPI encryption rejection: %w", err)
+		}
+		return pc.handleStartupMessage(pgconn)
+
 	case *pgproto3.CancelRequest:
-		logger.Info("cancel request received: PID=%d, secret_key=%d", msg.ProcessID, msg.SecretKey)
+		trace.SpanFromContext(pc.ctx).SetName("gprxy.cancel")
+		pc.log.Info("cancel request received: PID=%d, secret_key=%d", msg.ProcessID, msg.SecretKey)
 		targetConn, exists := pc.server.getConnectionForCancelRequest(msg.ProcessID, msg.SecretKey)
 		if !exists {
-			logger.Warn("cancel request for unknown connection")
-			return nil, logger.Errorf("cancel request processed - connection unknown")
+			metrics.CancelRequests.WithLabelValues("unknown").Inc()
+			pc.log.Warn("cancel request for unknown connection")
+			return nil, pc.log.Errorf("cancel request processed - connection unknown")
 		}
 
-		logger.Debug("found target connection: user=%s, db=%s", targetConn.user, targetConn.db)
+		pc.log.Debug("found target connection: user=%s, db=%s", targetConn.user, targetConn.db)
+
+		backendCancel, backendAddr, busy := targetConn.backendKey()
+		if !busy {
+			metrics.CancelRequests.WithLabelValues("idle").Inc()
+			pc.log.Info("cancel request ignored: connection has no backend assigned")
+			return nil, pc.log.Errorf("cancel request processed - connection idle")
+		}
 
-		err := cancelRequest(pc.config.DBHost, msg)
+		err := cancelRequest(backendAddr, backendCancel)
 		if err != nil {
-			logger.Error("failed to forward cancel request: %v", err)
-			return nil, logger.Errorf("cancel request failed: %w", err)
+			metrics.CancelRequests.WithLabelValues("failed").Inc()
+			pc.log.Error("failed to forward cancel request: %v", err)
+			return nil, pc.log.Errorf("cancel request failed: %w", err)
 		}
-		logger.Info("cancel request forwarded successfully")
-		return nil, logger.Errorf("cancel request processed")
+		metrics.CancelRequests.WithLabelValues("forwarded").Inc()
+		pc.log.Info("cancel request forwarded successfully")
+		return nil, pc.log.Errorf("cancel request processed")
+
+	default:
+		return nil, pc.log.Errorf("unexpected startup message: %T", msg)
 	}
 
 	return pgconn, nil
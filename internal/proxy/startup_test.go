@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgproto3/v2"
+
+	"gprxy/internal/config"
+)
+
+// Startup negotiation codes as sent by libpq
+const (
+	gssEncRequestCode = 80877104
+	sslRequestCode    = 80877103
+)
+
+// startProxyConnection accepts a single client on a loopback listener and
+// serves it like Server.Start does under the given listener policy. It returns
+// the client side of the connection.
+func startProxyConnection(t *testing.T, cfg *config.Config, policy *config.Listener, tlsConfig *tls.Config) net.Conn {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		pc := &Connection{
+			conn:       conn,
+			config:     cfg,
+			listener:   policy,
+			tlsConfig:  tlsConfig,
+			statements: make(map[string]*preparedStatement),
+		}
+		pc.handleConnection()
+	}()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// negotiate sends a GSSEncRequest or SSLRequest and returns the proxy's
+// single-byte answer
+func negotiate(t *testing.T, conn net.Conn, code uint32) byte {
+	t.Helper()
+
+	request := make([]byte, 8)
+	binary.BigEndian.PutUint32(request[0:4], 8)
+	binary.BigEndian.PutUint32(request[4:8], code)
+	if _, err := conn.Write(request); err != nil {
+		t.Fatalf("send request %d: %v", code, err)
+	}
+
+	response := make([]byte, 1)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		t.Fatalf("read response to request %d: %v", code, err)
+	}
+	return response[0]
+}
+
+// startupError sends a StartupMessage and returns the ErrorResponse the proxy
+// answers with
+func startupError(t *testing.T, conn net.Conn) *pgproto3.ErrorResponse {
+	t.Helper()
+
+	frontend := pgproto3.NewFrontend(pgproto3.NewChunkReader(conn), conn)
+	err := frontend.Send(&pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"user": "alice", "database": "orders"},
+	})
+	if err != nil {
+		t.Fatalf("send startup message: %v", err)
+	}
+
+	msg, err := frontend.Receive()
+	if err != nil {
+		t.Fatalf("receive startup response: %v", err)
+	}
+	errResp, ok := msg.(*pgproto3.ErrorResponse)
+	if !ok {
+		t.Fatalf("expected ErrorResponse, got %T", msg)
+	}
+	return errResp
+}
+
+// selfSignedTLS returns a server TLS configuration with a throwaway certificate
+func selfSignedTLS(t *testing.T) *tls.Config {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "gprxy-test"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		NextProtos:   []string{alpnPostgreSQL},
+	}
+}
+
+// closedAddress returns a loopback address nothing listens on
+func closedAddress(t *testing.T) (string, string) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	ln.Close()
+	return host, port
+}
+
+// TestGSSEncRequestThenSSLRequest replays libpq's default negotiation
+// (gssencmode=prefer, sslmode=prefer) against a proxy with TLS enabled: the
+// GSSAPI request is refused, TLS is accepted and the startup continues over the
+// encrypted connection until it reaches the upstream.
+func TestGSSEncRequestThenSSLRequest(t *testing.T) {
+	host, port := closedAddress(t)
+	cfg := &config.Config{
+		Upstreams: map[string]*config.Upstream{
+			config.DefaultUpstream: {Name: config.DefaultUpstream, Host: host, Port: port, SSLMode: "disable"},
+		},
+		PoolMode: config.PoolModeSession,
+	}
+	policy := &config.Listener{Name: config.DefaultListener, TLSMode: config.TLSModeAllow, Auth: config.AllAuthMethods}
+	conn := startProxyConnection(t, cfg, policy, selfSignedTLS(t))
+
+	if got := negotiate(t, conn, gssEncRequestCode); got != 'N' {
+		t.Fatalf("GSSEncRequest: expected 'N', got %q", got)
+	}
+	if got := negotiate(t, conn, sslRequestCode); got != 'S' {
+		t.Fatalf("SSLRequest: expected 'S', got %q", got)
+	}
+
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{alpnPostgreSQL}})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("TLS handshake: %v", err)
+	}
+
+	// No PostgreSQL is listening upstream, so authentication fails there
+	errResp := startupError(t, tlsConn)
+	if errResp.Code != "08006" {
+		t.Fatalf("expected SQLSTATE 08006 from the unreachable upstream, got %s: %s", errResp.Code, errResp.Message)
+	}
+}
+
+// TestGSSEncRequestThenPlaintextStartup covers a proxy without TLS: both
+// encryption requests are refused and the plaintext startup that follows is
+// handled by the TLS policy rather than being dropped.
+func TestGSSEncRequestThenPlaintextStartup(t *testing.T) {
+	policy := &config.Listener{Name: config.DefaultListener, TLSMode: config.TLSModeRequire, Auth: config.AllAuthMethods}
+	conn := startProxyConnection(t, &config.Config{}, policy, nil)
+
+	if got := negotiate(t, conn, gssEncRequestCode); got != 'N' {
+		t.Fatalf("GSSEncRequest: expected 'N', got %q", got)
+	}
+	if got := negotiate(t, conn, sslRequestCode); got != 'N' {
+		t.Fatalf("SSLRequest: expected 'N', got %q", got)
+	}
+
+	errResp := startupError(t, conn)
+	if errResp.Severity != "FATAL" || errResp.Code != invalidAuthorization {
+		t.Fatalf("expected FATAL %s, got %s %s: %s", invalidAuthorization, errResp.Severity, errResp.Code, errResp.Message)
+	}
+}
@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jackc/pgproto3/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"gprxy/internal/tracing"
+)
+
+const (
+	// defaultApplicationName labels traced backend sessions of clients that
+	// did not send an application_name
+	defaultApplicationName = "gprxy"
+	// maxApplicationName is PostgreSQL's limit on application_name, beyond
+	// which the server truncates it
+	maxApplicationName = 63
+	// traceResetQuery undoes the trace label when it is the only setting the
+	// proxy made on a pooled backend
+	traceResetQuery = "RESET application_name"
+)
+
+// handshakeTLS performs the server side of a TLS handshake, traced as a child
+// of the connection span
+func (pc *Connection) handshakeTLS(conn net.Conn, direct bool) (*tls.Conn, error) {
+	_, span := tracing.Tracer().Start(pc.ctx, "tls.handshake", trace.WithAttributes(attribute.Bool("gprxy.tls.direct", direct)))
+	tlsConn := tls.Server(conn, pc.tlsConfig)
+	err := tlsConn.Handshake()
+	if err == nil {
+		state := tlsConn.ConnectionState()
+		span.SetAttributes(
+			attribute.String("tls.protocol.version", tls.VersionName(state.Version)),
+			attribute.String("tls.cipher", tls.CipherSuiteName(state.CipherSuite)),
+			attribute.Bool("tls.client.certificate", len(state.PeerCertificates) > 0),
+		)
+	}
+	tracing.End(span, err)
+	return tlsConn, err
+}
+
+// traceSetting returns a statement that appends the connection's traceparent
+// to the client's application_name on the backend, so statements in the
+// database logs (log_line_prefix %a) and pg_stat_activity can be matched to
+// their trace. It returns "" when the connection is not traced, or when the
+// client sets application_name itself and the label would override it.
+func (pc *Connection) traceSetting() string {
+	traceparent := tracing.Traceparent(pc.ctx)
+	if traceparent == "" || setsApplicationName(pc.sessionSets) {
+		return ""
+	}
+	return fmt.Sprintf("SET application_name = '%s'",
+		strings.ReplaceAll(traceLabel(pc.appName, traceparent), "'", "''"))
+}
+
+// traceLabel joins an application name and a traceparent, shortening the name
+// so the traceparent survives PostgreSQL's length limit
+func traceLabel(appName, traceparent string) string {
+	if appName == "" {
+		appName = defaultApplicationName
+	}
+	room := maxApplicationName - len(traceparent) - 1
+	if len(appName) > room {
+		appName = appName[:max(room, 0)]
+		for len(appName) > 0 && !utf8.ValidString(appName) {
+			appName = appName[:len(appName)-1]
+		}
+	}
+	return appName + " " + traceparent
+}
+
+// setsApplicationName reports whether any of the tracked session settings
+// changes application_name
+func setsApplicationName(sets []string) bool {
+	for _, stmt := range sets {
+		words := leadingKeywords(stmt, 3)
+		if len(words) > 1 && words[1] == "session" {
+			words = words[1:]
+		}
+		if len(words) > 1 && words[1] == "application_name" {
+			return true
+		}
+	}
+	return false
+}
+
+// startQuerySpan starts the span for one statement round trip: a simple Query
+// or an extended-protocol Execute forwarded to the backend. Other requests
+// are not traced on their own.
+func (pc *Connection) startQuerySpan(request byte) trace.Span {
+	name := "query"
+	if request == 'E' {
+		name = "execute"
+	}
+	_, span := tracing.Tracer().Start(pc.ctx, name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", "postgresql"),
+			attribute.String("db.name", pc.db),
+			attribute.String("db.user", pc.user),
+			attribute.String("gprxy.route", pc.route),
+		))
+	return span
+}
+
+// traceReply records a backend message on the span of the reply at the head
+// of the queue
+func (pc *Connection) traceReply(msg pgproto3.BackendMessage) {
+	if len(pc.replies) == 0 || pc.replies[0].span == nil {
+		return
+	}
+	span := pc.replies[0].span
+	switch msg := msg.(type) {
+	case *pgproto3.CommandComplete:
+		span.SetAttributes(attribute.String("db.command_tag", string(msg.CommandTag)))
+	case *pgproto3.ErrorResponse:
+		span.SetAttributes(attribute.String("db.response.status_code", msg.Code))
+		span.SetStatus(codes.Error, msg.Message)
+	}
+}
+
+// endReplySpan ends the span of a reply leaving the queue, if it has one
+func endReplySpan(reply *pendingReply) {
+	if reply.span != nil {
+		reply.span.End()
+	}
+}
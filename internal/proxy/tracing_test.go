@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+
+	"gprxy/internal/config"
+	"gprxy/internal/tracing"
+)
+
+// collectorStub is an OTLP/HTTP trace receiver that keeps every span it is sent
+type collectorStub struct {
+	mu    sync.Mutex
+	spans map[string][]byte // Span name to trace ID
+	names []string
+}
+
+func (c *collectorStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var request collectortrace.ExportTraceServiceRequest
+	if err := proto.Unmarshal(body, &request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, resourceSpans := range request.ResourceSpans {
+		for _, scopeSpans := range resourceSpans.ScopeSpans {
+			for _, span := range scopeSpans.Spans {
+				c.spans[span.Name] = span.TraceId
+				c.names = append(c.names, span.Name)
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	response, _ := proto.Marshal(&collectortrace.ExportTraceServiceResponse{})
+	w.Write(response)
+}
+
+// TestStartupSpansExported runs a TLS startup against an unreachable upstream
+// with an OTLP collector configured and checks the connection, handshake and
+// authentication spans reach it as one trace
+func TestStartupSpansExported(t *testing.T) {
+	collector := &collectorStub{spans: make(map[string][]byte)}
+	srv := httptest.NewServer(collector)
+	defer srv.Close()
+
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", srv.URL+"/v1/traces")
+	t.Setenv("OTEL_BSP_SCHEDULE_DELAY", "20")
+	shutdown, err := tracing.Init(context.Background())
+	if err != nil {
+		t.Fatalf("init tracing: %v", err)
+	}
+	defer shutdown(context.Background())
+
+	host, port := closedAddress(t)
+	cfg := &config.Config{
+		Upstreams: map[string]*config.Upstream{
+			config.DefaultUpstream: {Name: config.DefaultUpstream, Host: host, Port: port, SSLMode: "disable"},
+		},
+		PoolMode: config.PoolModeSession,
+	}
+	policy := &config.Listener{Name: config.DefaultListener, TLSMode: config.TLSModeAllow, Auth: config.AllAuthMethods}
+	conn := startProxyConnection(t, cfg, policy, selfSignedTLS(t))
+
+	if got := negotiate(t, conn, sslRequestCode); got != 'S' {
+		t.Fatalf("SSLRequest: expected 'S', got %q", got)
+	}
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{alpnPostgreSQL}})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("TLS handshake: %v", err)
+	}
+	startupError(t, tlsConn)
+
+	// The connection span ends after the proxy has cleaned up, so wait for
+	// the batch that carries it
+	var root []byte
+	for deadline := time.Now().Add(5 * time.Second); root == nil && time.Now().Before(deadline); {
+		time.Sleep(20 * time.Millisecond)
+		collector.mu.Lock()
+		root = collector.spans["gprxy.connection"]
+		collector.mu.Unlock()
+	}
+
+	collector.mu.Lock()
+	defer collector.mu.Unlock()
+	if root == nil {
+		t.Fatalf("connection span not exported, got %v", collector.names)
+	}
+	for _, name := range []string{"tls.handshake", "auth.authenticate"} {
+		traceID, ok := collector.spans[name]
+		if !ok {
+			t.Fatalf("%s span not exported, got %v", name, collector.names)
+		}
+		if string(traceID) != string(root) {
+			t.Errorf("%s span is not part of the connection trace", name)
+		}
+	}
+}
+
+func TestTraceLabel(t *testing.T) {
+	const traceparent = "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	tests := []struct {
+		appName string
+		want    string
+	}{
+		{"", "gprxy " + traceparent},
+		{"psql", "psql " + traceparent},
+		{"billing-worker", "billing " + traceparent},
+		{"añadidos", "añadid " + traceparent},
+		{"aaaaaañ", "aaaaaa " + traceparent},
+	}
+	for _, tt := range tests {
+		got := traceLabel(tt.appName, traceparent)
+		if got != tt.want {
+			t.Errorf("traceLabel(%q) = %q, want %q", tt.appName, got, tt.want)
+		}
+		if len(got) > maxApplicationName {
+			t.Errorf("traceLabel(%q) is %d bytes, over the %d-byte limit", tt.appName, len(got), maxApplicationName)
+		}
+	}
+}
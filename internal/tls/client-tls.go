@@ -3,14 +3,33 @@
 package tls
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/binary"
+	"encoding/hex"
 	"net"
+	"os"
+	"strings"
 
 	"gprxy/internal/logger"
 )
 
-func UpgradeToTLS(conn net.Conn, serverName string) (net.Conn, error) {
+// ClientOptions controls how the CLI authenticates the proxy
+type ClientOptions struct {
+	ServerName    string // Host name the proxy certificate must be valid for
+	CAFile        string // CA bundle to verify the proxy with; empty uses the system roots
+	PinSHA256     string // Hex SHA-256 fingerprint of the proxy certificate; replaces CA verification when set
+	AllowInsecure bool   // Continue in plaintext if the proxy does not support TLS
+}
+
+func UpgradeToTLS(conn net.Conn, opts ClientOptions) (net.Conn, error) {
+	tlsConfig, err := clientConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+
 	sslreq := make([]byte, 8)
 	binary.BigEndian.PutUint32(sslreq[0:4], 8)        //length
 	binary.BigEndian.PutUint32(sslreq[4:8], 80877103) // ssl code
@@ -25,16 +44,13 @@ func UpgradeToTLS(conn net.Conn, serverName string) (net.Conn, error) {
 	}
 
 	if response[0] == 'N' {
-		logger.Warn("proxy does not support TLS")
+		if !opts.AllowInsecure {
+			return nil, logger.Errorf("proxy does not support TLS, refusing to send credentials in plaintext (use --insecure to override)")
+		}
+		logger.Warn("proxy does not support TLS, continuing in plaintext because --insecure was given")
 		return conn, nil
 	}
 
-	tlsConfig := &tls.Config{
-		ServerName:         serverName,
-		InsecureSkipVerify: true,
-		MinVersion:         tls.VersionTLS12,
-	}
-
 	tlsconn := tls.Client(conn, tlsConfig)
 	if err := tlsconn.Handshake(); err != nil {
 		return nil, logger.Errorf("tls handshake failed: %w", err)
@@ -50,3 +66,48 @@ func UpgradeToTLS(conn net.Conn, serverName string) (net.Conn, error) {
 	return tlsconn, nil
 
 }
+
+// clientConfig builds the TLS configuration for connecting to the proxy. The
+// certificate is verified against the system roots or opts.CAFile, or, when a
+// fingerprint is pinned, must match that fingerprint exactly.
+func clientConfig(opts ClientOptions) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName: opts.ServerName,
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"postgresql"},
+	}
+
+	if opts.CAFile != "" {
+		pem, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, logger.Errorf("failed to read CA file: %w", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, logger.Errorf("no certificates found in CA file %s", opts.CAFile)
+		}
+		tlsConfig.RootCAs = roots
+	}
+
+	if opts.PinSHA256 != "" {
+		pin, err := hex.DecodeString(strings.ReplaceAll(opts.PinSHA256, ":", ""))
+		if err != nil || len(pin) != sha256.Size {
+			return nil, logger.Errorf("invalid SHA-256 fingerprint %q", opts.PinSHA256)
+		}
+		// The pin identifies the certificate on its own, so self-signed
+		// proxy certificates work without a CA
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return logger.Errorf("proxy presented no certificate")
+			}
+			fingerprint := sha256.Sum256(rawCerts[0])
+			if !bytes.Equal(fingerprint[:], pin) {
+				return logger.Errorf("proxy certificate fingerprint %s does not match pinned %s",
+					hex.EncodeToString(fingerprint[:]), hex.EncodeToString(pin))
+			}
+			return nil
+		}
+	}
+	return tlsConfig, nil
+}
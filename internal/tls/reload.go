@@ -0,0 +1,139 @@
+package tls
+
+import (
+	"bytes"
+	"crypto/tls"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"gprxy/internal/logger"
+)
+
+// certExpiryWarning is how close to expiry a loaded certificate gets logged as
+// a warning instead of informationally
+const certExpiryWarning = 7 * 24 * time.Hour
+
+// certReloader serves the proxy certificate through GetCertificate and swaps
+// it when the files change on disk or the process receives SIGHUP. A pair that
+// fails to load or validate is logged and the previous certificate stays in
+// use, so a half-written secret rotation never takes the listener down.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+	// Contents of the files the current certificate was loaded from, so
+	// polling only reloads when something actually changed
+	certPEM []byte
+	keyPEM  []byte
+	// Contents that last failed to load, so a broken pair is reported once
+	// rather than on every poll
+	rejectedPEM []byte
+}
+
+// newCertReloader loads the initial certificate pair. Failing to load it is an
+// error since there is nothing to fall back to yet.
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// reload reads the certificate pair and swaps it in if it changed and is
+// valid. It reports whether a new certificate was installed.
+func (r *certReloader) reload() (bool, error) {
+	certPEM, err := os.ReadFile(r.certFile)
+	if err != nil {
+		return false, logger.Errorf("failed to read TLS certificate: %w", err)
+	}
+	keyPEM, err := os.ReadFile(r.keyFile)
+	if err != nil {
+		return false, logger.Errorf("failed to read TLS key: %w", err)
+	}
+
+	combined := append(append([]byte(nil), certPEM...), keyPEM...)
+	r.mu.RLock()
+	unchanged := bytes.Equal(certPEM, r.certPEM) && bytes.Equal(keyPEM, r.keyPEM) ||
+		bytes.Equal(combined, r.rejectedPEM)
+	r.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err == nil && time.Now().After(cert.Leaf.NotAfter) {
+		err = logger.Errorf("certificate expired at %s", cert.Leaf.NotAfter.Format(time.RFC3339))
+	}
+	if err != nil {
+		r.mu.Lock()
+		r.rejectedPEM = combined
+		r.mu.Unlock()
+		return false, logger.Errorf("invalid TLS certificate pair: %w", err)
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.certPEM = certPEM
+	r.keyPEM = keyPEM
+	r.rejectedPEM = nil
+	r.mu.Unlock()
+
+	logCertExpiry(&cert)
+	return true, nil
+}
+
+// watch reloads the certificate every interval and on SIGHUP. An interval of
+// zero disables polling.
+func (r *certReloader) watch(interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-hup:
+			logger.Info("SIGHUP received, reloading TLS certificate")
+		case <-tick:
+		}
+
+		reloaded, err := r.reload()
+		if err != nil {
+			logger.Error("TLS certificate reload failed, keeping the current certificate: %v", err)
+			continue
+		}
+		if reloaded {
+			logger.Info("TLS certificate reloaded (cert: %s, key: %s)", r.certFile, r.keyFile)
+		}
+	}
+}
+
+func logCertExpiry(cert *tls.Certificate) {
+	leaf := cert.Leaf
+	remaining := time.Until(leaf.NotAfter)
+	if remaining < certExpiryWarning {
+		logger.Warn("TLS certificate %s expires soon: %s (in %s)",
+			leaf.Subject, leaf.NotAfter.Format(time.RFC3339), remaining.Round(time.Minute))
+		return
+	}
+	logger.Info("TLS certificate %s valid until %s (%d days)",
+		leaf.Subject, leaf.NotAfter.Format(time.RFC3339), int(remaining.Hours()/24))
+}
@@ -2,8 +2,10 @@ package tls
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"log"
 	"os"
+	"time"
 
 	"github.com/joho/godotenv"
 
@@ -12,6 +14,10 @@ import (
 
 // Implements server side tls configuration for the proxy - It handles and configures tls for incoming connections from clients and when client connects and sends SSLRequest the proxy uses this config to upgrade connection to TLS
 
+// defaultCertReloadInterval is how often the certificate files are checked for
+// changes unless PROXY_CERT_RELOAD_INTERVAL says otherwise
+const defaultCertReloadInterval = 30 * time.Second
+
 // Load loads TLS configuration from environment variables
 // Returns nil if TLS is not configured (allowing proxy to run without TLS)
 func Load() *tls.Config {
@@ -29,17 +35,28 @@ func Load() *tls.Config {
 		return nil
 	}
 
-	// Load the certificate and private key
-	cert, err := tls.LoadX509KeyPair(proxyCert, proxyKey)
+	// Load the certificate and private key, reloading them when they change
+	reloadInterval := defaultCertReloadInterval
+	if value := os.Getenv("PROXY_CERT_RELOAD_INTERVAL"); value != "" {
+		reloadInterval, err = time.ParseDuration(value)
+		if err != nil {
+			log.Fatalf("invalid PROXY_CERT_RELOAD_INTERVAL %q: %v", value, err)
+		}
+	}
+	reloader, err := newCertReloader(proxyCert, proxyKey)
 	if err != nil {
 		log.Fatalf("failed to load TLS certificate: %v", err)
 	}
+	go reloader.watch(reloadInterval)
 
 	// Create TLS config with security best practices
 	config := &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		MinVersion:   tls.VersionTLS12, // TLS 1.2 minimum (PostgreSQL standard)
-		MaxVersion:   tls.VersionTLS13, // Allow TLS 1.3
+		GetCertificate: reloader.GetCertificate,
+		MinVersion:     tls.VersionTLS12, // TLS 1.2 minimum (PostgreSQL standard)
+		MaxVersion:     tls.VersionTLS13, // Allow TLS 1.3
+
+		// ALPN as negotiated by PostgreSQL 17; required for direct TLS
+		NextProtos: []string{"postgresql"},
 
 		// Prefer server cipher suites for better security
 		PreferServerCipherSuites: true,
@@ -62,6 +79,33 @@ func Load() *tls.Config {
 		},
 	}
 
+	// Optional mutual TLS: verify client certificates against a CA bundle
+	clientCA := os.Getenv("PROXY_CLIENT_CA")
+	clientAuth := os.Getenv("PROXY_CLIENT_AUTH")
+	if clientCA != "" {
+		pem, err := os.ReadFile(clientCA)
+		if err != nil {
+			log.Fatalf("failed to read client CA bundle: %v", err)
+		}
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			log.Fatalf("no certificates found in client CA bundle %s", clientCA)
+		}
+		config.ClientCAs = clientCAs
+
+		switch clientAuth {
+		case "", "optional":
+			config.ClientAuth = tls.VerifyClientCertIfGiven
+		case "require":
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		default:
+			log.Fatalf("invalid PROXY_CLIENT_AUTH %q (expected optional or require)", clientAuth)
+		}
+		logger.Info("client certificate verification enabled (CA: %s, mode: %s)", clientCA, config.ClientAuth)
+	} else if clientAuth != "" {
+		log.Fatalf("PROXY_CLIENT_AUTH requires PROXY_CLIENT_CA")
+	}
+
 	logger.Info("TLS configured successfully (cert: %s, key: %s)", proxyCert, proxyKey)
 	return config
 }
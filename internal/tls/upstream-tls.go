@@ -0,0 +1,140 @@
+// This implements TLS from the proxy to PostgreSQL for the temporary
+// authentication connection. Pooled connections get the same settings through
+// their connection string, so both legs follow libpq sslmode semantics.
+
+package tls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"net"
+	"os"
+
+	"gprxy/internal/config"
+	"gprxy/internal/logger"
+)
+
+// LoadUpstream builds the TLS configuration for connections to an upstream.
+// It returns nil when the upstream's sslmode does not use TLS.
+func LoadUpstream(upstream *config.Upstream) (*tls.Config, error) {
+	mode := upstream.SSLMode
+	switch mode {
+	case "disable", "allow":
+		return nil, nil
+	case "":
+		mode = "prefer"
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName: upstream.Host,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if upstream.SSLRootCert != "" {
+		pem, err := os.ReadFile(upstream.SSLRootCert)
+		if err != nil {
+			return nil, logger.Errorf("failed to read upstream CA bundle: %w", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, logger.Errorf("no certificates found in upstream CA bundle %s", upstream.SSLRootCert)
+		}
+		tlsConfig.RootCAs = roots
+	}
+
+	if upstream.SSLCert != "" {
+		cert, err := tls.LoadX509KeyPair(upstream.SSLCert, upstream.SSLKey)
+		if err != nil {
+			return nil, logger.Errorf("failed to load upstream client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	// Like libpq, require verifies the chain when a CA bundle is given
+	if mode == "require" && upstream.SSLRootCert != "" {
+		mode = "verify-ca"
+	}
+
+	switch mode {
+	case "prefer", "require":
+		tlsConfig.InsecureSkipVerify = true
+	case "verify-ca":
+		// Verify the chain but not the host name
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyChain(rawCerts, tlsConfig.RootCAs)
+		}
+	}
+	return tlsConfig, nil
+}
+
+// verifyChain verifies a server certificate chain against roots, or against the
+// system roots if roots is nil
+func verifyChain(rawCerts [][]byte, roots *x509.CertPool) error {
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return logger.Errorf("failed to parse server certificate: %w", err)
+		}
+		certs[i] = cert
+	}
+	if len(certs) == 0 {
+		return logger.Errorf("server presented no certificate")
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	return err
+}
+
+// ConnectUpstream negotiates TLS on a fresh connection to an upstream according
+// to its sslmode. With prefer the connection stays in plaintext if the server
+// declines TLS; stricter modes fail instead.
+func ConnectUpstream(conn net.Conn, upstream *config.Upstream) (net.Conn, error) {
+	tlsConfig, err := LoadUpstream(upstream)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig == nil {
+		return conn, nil
+	}
+
+	sslreq := make([]byte, 8)
+	binary.BigEndian.PutUint32(sslreq[0:4], 8)        //length
+	binary.BigEndian.PutUint32(sslreq[4:8], 80877103) // ssl code
+
+	if _, err := conn.Write(sslreq); err != nil {
+		return nil, logger.Errorf("failed to send SSL request to upstream: %w", err)
+	}
+
+	response := make([]byte, 1)
+	if _, err := conn.Read(response); err != nil {
+		return nil, logger.Errorf("failed to read SSL response from upstream: %w", err)
+	}
+
+	if response[0] != 'S' {
+		if upstream.SSLMode == "" || upstream.SSLMode == "prefer" {
+			logger.Debug("upstream %s does not support TLS, continuing without it", upstream.Name)
+			return conn, nil
+		}
+		return nil, logger.Errorf("upstream %s does not support TLS (sslmode=%s)", upstream.Name, upstream.SSLMode)
+	}
+
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, logger.Errorf("upstream TLS handshake failed: %w", err)
+	}
+
+	state := tlsConn.ConnectionState()
+	logger.Debug("upstream %s TLS established (%s, cipher: %s)", upstream.Name,
+		tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite))
+	return tlsConn, nil
+}
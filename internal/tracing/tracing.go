@@ -0,0 +1,95 @@
+// Package tracing sets up OpenTelemetry tracing for the proxy. Spans are
+// exported over OTLP/HTTP when an OTLP endpoint is configured through the
+// standard OTEL_EXPORTER_OTLP_* variables; otherwise every span is a no-op.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+
+	"gprxy/internal/logger"
+)
+
+const (
+	instrumentationName = "gprxy"
+	defaultServiceName  = "gprxy"
+)
+
+// Enabled reports whether an OTLP endpoint is configured
+func Enabled() bool {
+	return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+}
+
+// Init installs the global tracer provider. The returned function flushes
+// pending spans and must be called before the process exits. Without an OTLP
+// endpoint it installs nothing and the returned function does nothing.
+func Init(ctx context.Context) (func(context.Context) error, error) {
+	if !Enabled() {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	// Endpoint, headers, TLS and timeouts come from OTEL_EXPORTER_OTLP_*
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the defaults
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", defaultServiceName)),
+		resource.WithFromEnv(),
+		resource.WithHost(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build trace resource: %w", err)
+	}
+
+	// The sampler follows OTEL_TRACES_SAMPLER, sampling everything by default
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		logger.Warn("tracing: %v", err)
+	}))
+
+	logger.Info("tracing enabled, exporting spans over OTLP/HTTP")
+	return provider.Shutdown, nil
+}
+
+// Tracer returns the proxy's tracer
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// Traceparent formats the span context in ctx as a W3C traceparent header
+// value, or returns "" if ctx carries no sampled span
+func Traceparent(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(ctx, carrier)
+	if !trace.SpanContextFromContext(ctx).IsSampled() {
+		return ""
+	}
+	return carrier.Get("traceparent")
+}
+
+// End ends span, marking it failed if err is not nil
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}